@@ -4,10 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	socks5 "github.com/ojbkgo/socks5-protocol"
 
@@ -16,27 +19,83 @@ import (
 
 // 参数 本地http监听地址
 var (
-	HTTPAddr   string
-	HTTPPort   int
-	RemoteAddr string
-	RemotePort int
-	Username   string
-	Password   string
-	AuthMethod int
-	PProf      bool
+	HTTPAddr         string
+	HTTPPort         int
+	RemoteAddr       string
+	RemotePort       int
+	RemoteServers    string
+	RemoteStrategy   string
+	Username         string
+	Password         string
+	AuthMethod       int
+	AuthMethods      string
+	PProf            bool
+	Via              bool
+	XForwardedFor    bool
+	ProxyUsersFile   string
+	ProxyPassThrough bool
+	PAC              bool
+	PACDirect        string
+	PACProxy         string
+	PACProxyDefault  bool
+	PACProxyAddr     string
+	SocksAddr        string
+	SocksPort        int
+	SocksUser        string
+	SocksPass        string
+	SocksNoAuthLocal bool
+	TLS              bool
+	TLSCA            string
+	TLSServerName    string
+	TLSCert          string
+	TLSKey           string
+	MuxSessions      int
+	PoolSize         int
+	PoolIdleTimeout  time.Duration
+	PoolMaxLifetime  time.Duration
+	ProbeInterval    time.Duration
+	ProbeTarget      string
 
 	RemoteConfig = pkg.ClientConfig{}
 )
 
 func init() {
-	flag.StringVar(&HTTPAddr, "http", "0.0.0.0", "http server listen address")
+	flag.StringVar(&HTTPAddr, "http", "", "http server listen address, defaults to 127.0.0.1 without http proxy auth, 0.0.0.0 with it")
 	flag.IntVar(&HTTPPort, "port", 18080, "http server listen port")
 	flag.StringVar(&RemoteAddr, "remote-addr", "127.0.0.1", "remote server address")
 	flag.IntVar(&RemotePort, "remote-port", 1080, "remote server port")
+	flag.StringVar(&RemoteServers, "remote-servers", "", "comma separated remote servers host:port, overrides -remote-addr/-remote-port")
+	flag.StringVar(&RemoteStrategy, "remote-strategy", pkg.RemoteStrategyRoundRobin, "how to pick among -remote-servers: round-robin, least-conn or latency")
 	flag.StringVar(&Username, "username", "", "remote server username")
 	flag.StringVar(&Password, "password", "", "remote server password")
 	flag.IntVar(&AuthMethod, "auth-method", int(socks5.Socks5MethodUserPass), "remote server auth method")
+	flag.StringVar(&AuthMethods, "auth-methods", "", "remote server auth methods offered in order, e.g. \"userpass,noauth\", overrides -auth-method")
 	flag.BoolVar(&PProf, "pprof", false, "enable pprof")
+	flag.BoolVar(&Via, "via", false, "add Via header to forwarded http requests")
+	flag.BoolVar(&XForwardedFor, "x-forwarded-for", false, "append client ip to X-Forwarded-For header of forwarded http requests")
+	flag.StringVar(&ProxyUsersFile, "proxy-users-file", "", "http proxy users file, one \"user:bcrypt/argon2id hash\" per line, requires Proxy-Authorization when set")
+	flag.BoolVar(&ProxyPassThrough, "proxy-auth-passthrough", false, "require Proxy-Authorization and use its username/password for the remote server")
+	flag.BoolVar(&PAC, "pac", false, "serve proxy auto-config at /proxy.pac and /wpad.dat")
+	flag.StringVar(&PACDirect, "pac-direct", "", "comma separated domains connected directly in the pac file")
+	flag.StringVar(&PACProxy, "pac-proxy", "", "comma separated domains sent through the proxy in the pac file")
+	flag.BoolVar(&PACProxyDefault, "pac-proxy-default", false, "send domains matching no pac rule through the proxy")
+	flag.StringVar(&PACProxyAddr, "pac-proxy-addr", "", "proxy host:port written to the pac file, defaults to the address the browser fetched it from")
+	flag.StringVar(&SocksAddr, "socks", "127.0.0.1", "local socks5 server listen address")
+	flag.IntVar(&SocksPort, "socks-port", 0, "local socks5 server listen port, 0 to disable")
+	flag.StringVar(&SocksUser, "socks-user", "", "local socks5 server auth user, no auth when empty")
+	flag.StringVar(&SocksPass, "socks-pass", "", "local socks5 server auth pass")
+	flag.BoolVar(&SocksNoAuthLocal, "socks-no-auth-local", true, "allow localhost to use the local socks5 server without auth when -socks-user is set")
+	flag.BoolVar(&TLS, "tls", false, "connect to remote server over tls")
+	flag.StringVar(&TLSCA, "tls-ca", "", "only trust remote server certificates signed by this CA")
+	flag.StringVar(&TLSServerName, "tls-server-name", "", "server name for SNI and certificate verification, defaults to -remote-addr")
+	flag.StringVar(&TLSCert, "tls-cert", "", "client certificate file for mutual tls")
+	flag.StringVar(&TLSKey, "tls-key", "", "client private key file for mutual tls")
+	flag.IntVar(&MuxSessions, "mux-sessions", 0, "multiplex connections over this many long-lived sessions to remote server, 0 to disable, requires -mux on the server")
+	flag.IntVar(&PoolSize, "pool-size", 0, "keep this many connections to remote server authenticated in advance, 0 to disable")
+	flag.DurationVar(&PoolIdleTimeout, "pool-idle-timeout", time.Minute, "close pooled connections idle longer than this")
+	flag.DurationVar(&PoolMaxLifetime, "pool-max-lifetime", 0, "close pooled connections older than this, 0 for no limit")
+	flag.DurationVar(&ProbeInterval, "probe-interval", 0, "probe remote servers with handshake and auth at this interval, 0 to disable; results are logged and served at /debug/vars with -pprof")
+	flag.StringVar(&ProbeTarget, "probe-target", "", "host:port to CONNECT to when probing, only handshake and auth when empty")
 	flag.Parse()
 	RemoteConfig = pkg.ClientConfig{
 		RemoteAddr: RemoteAddr,
@@ -44,6 +103,40 @@ func init() {
 		Username:   Username,
 		Password:   Password,
 		AuthMethod: socks5.Socks5Method(AuthMethod),
+
+		RemoteStrategy: RemoteStrategy,
+
+		MuxSessions: MuxSessions,
+
+		PoolSize:        PoolSize,
+		PoolIdleTimeout: PoolIdleTimeout,
+		PoolMaxLifetime: PoolMaxLifetime,
+	}
+	if RemoteServers != "" {
+		servers, err := pkg.ParseRemoteServers(RemoteServers)
+		if err != nil {
+			log.Fatalf("invalid remote servers: %v", err)
+		}
+		RemoteConfig.RemoteServers = servers
+	}
+	switch RemoteStrategy {
+	case pkg.RemoteStrategyRoundRobin, pkg.RemoteStrategyLeastConn, pkg.RemoteStrategyLatency:
+	default:
+		log.Fatalf("invalid remote strategy: %s", RemoteStrategy)
+	}
+	if AuthMethods != "" {
+		methods, err := pkg.ParseAuthMethods(AuthMethods)
+		if err != nil {
+			log.Fatalf("invalid auth methods: %v", err)
+		}
+		RemoteConfig.AuthMethods = methods
+	}
+	if TLS {
+		tlsConfig, err := pkg.NewClientTLSConfig(TLSCA, TLSServerName, TLSCert, TLSKey)
+		if err != nil {
+			log.Fatalf("invalid tls config: %v", err)
+		}
+		RemoteConfig.TLSConfig = tlsConfig
 	}
 }
 
@@ -57,41 +150,94 @@ func main() {
 			}
 		}()
 	}
-	// check RemoteAddr
-	if RemoteAddr == "" {
+	// check RemoteAddr, 指定了多个服务端时不使用
+	if RemoteServers == "" && RemoteAddr == "" {
 		log.Printf("remote server address is empty, exit.\n")
 		return
 	}
 
 	// check RemotePort
-	if RemotePort == 0 {
+	if RemoteServers == "" && RemotePort == 0 {
 		log.Printf("remote server port is empty, exit.\n")
 		return
 	}
 
-	// check Username
-	if Username == "" {
-		log.Printf("remote server username is empty, exit.\n")
-		return
+	// check Username/Password, 提供用户名密码认证时必填, 透传认证时使用 http 代理用户的用户名密码
+	methods := RemoteConfig.AuthMethods
+	if len(methods) == 0 {
+		methods = []socks5.Socks5Method{RemoteConfig.AuthMethod}
+	}
+	for _, m := range methods {
+		if m != socks5.Socks5MethodUserPass || ProxyPassThrough {
+			continue
+		}
+
+		if Username == "" {
+			log.Printf("remote server username is empty, exit.\n")
+			return
+		}
+
+		if Password == "" {
+			log.Printf("remote server password is empty, exit.\n")
+			return
+		}
 	}
 
-	// check Password
-	if Password == "" {
-		log.Printf("remote server password is empty, exit.\n")
-		return
+	var proxyCredentials pkg.CredentialStore
+	if ProxyUsersFile != "" {
+		store, err := pkg.NewFileCredentialStore(ProxyUsersFile)
+		if err != nil {
+			log.Printf("load http proxy users error: %v, exit.\n", err)
+			return
+		}
+		proxyCredentials = store
 	}
 
-	// check AuthMethod
-	if AuthMethod == 0 {
-		log.Printf("remote server auth method is empty, exit.\n")
+	// 没有 http 代理认证时只允许本机访问, 避免成为开放代理
+	proxyAuth := ProxyUsersFile != "" || ProxyPassThrough
+	switch {
+	case HTTPAddr == "" && proxyAuth:
+		HTTPAddr = "0.0.0.0"
+	case HTTPAddr == "":
+		HTTPAddr = "127.0.0.1"
+	case !proxyAuth && !isLoopbackHost(HTTPAddr):
+		log.Printf("http proxy listening on %s without -proxy-users-file or -proxy-auth-passthrough, exit.\n", HTTPAddr)
 		return
 	}
 
+	var pac *pkg.PACConfig
+	if PAC {
+		pac = &pkg.PACConfig{
+			DirectDomains:  splitList(PACDirect),
+			ProxyDomains:   splitList(PACProxy),
+			ProxyByDefault: PACProxyDefault,
+			ProxyAddr:      PACProxyAddr,
+		}
+	}
+
 	// listen signal
 	sig := make(chan os.Signal, 1)
 	osSignal := []os.Signal{os.Interrupt, os.Kill}
 	signal.Notify(sig, osSignal...)
-	proxy := pkg.NewHttpProxy(&RemoteConfig)
+	// http 代理和本地 socks5 服务共享到远端服务端的连接和健康状态
+	dialer := pkg.NewDialer(&RemoteConfig)
+	if ProbeInterval > 0 {
+		prober := pkg.NewProber(dialer, &pkg.ProberConfig{Interval: ProbeInterval, Target: ProbeTarget})
+		prober.PublishExpvar("remote_servers")
+		prober.Start()
+	}
+
+	proxy := pkg.NewHttpProxy(&RemoteConfig, &pkg.HttpProxyConfig{
+		Via:           Via,
+		XForwardedFor: XForwardedFor,
+
+		Credentials:     proxyCredentials,
+		PassThroughAuth: ProxyPassThrough,
+
+		PAC: pac,
+
+		Dialer: dialer,
+	})
 	ch := make(chan struct{})
 	go func() {
 		if err := proxy.Start(fmt.Sprintf("%s:%d", HTTPAddr, HTTPPort), ch); err != nil {
@@ -99,8 +245,64 @@ func main() {
 		}
 	}()
 
+	// 本地 socks5 服务, 请求通过远端服务端转发
+	if SocksPort != 0 {
+		socksServer := pkg.NewLocalSocksServerWithDialer(localSocksConfig(), dialer)
+		go func() {
+			if err := socksServer.Serve(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	select {
 	case <-sig:
 		close(ch)
 	}
 }
+
+// isLoopbackHost host 为 localhost 或回环地址
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localSocksConfig 未设置用户时不认证, 设置了用户时可以允许本机不认证
+func localSocksConfig() *pkg.ServerConfig {
+	config := &pkg.ServerConfig{
+		AuthMethod: socks5.Socks5MethodNoAuth,
+		Mode:       pkg.ServerMode_Socks,
+		Addr:       SocksAddr,
+		Port:       SocksPort,
+	}
+
+	if SocksUser != "" {
+		config.AuthMethod = socks5.Socks5MethodUserPass
+		config.User = SocksUser
+		config.Password = SocksPass
+
+		if SocksNoAuthLocal {
+			methods := []socks5.Socks5Method{socks5.Socks5MethodNoAuth, socks5.Socks5MethodUserPass}
+			for _, cidr := range []string{"127.0.0.0/8", "::1/128"} {
+				_, network, _ := net.ParseCIDR(cidr)
+				config.AuthPolicies = append(config.AuthPolicies, pkg.AuthPolicy{Network: network, Methods: methods})
+			}
+		}
+	}
+
+	return config
+}
+
+// splitList 按逗号分隔, 去掉空白和空项
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -4,4 +4,9 @@ go 1.21.0
 
 require github.com/ojbkgo/socks5-protocol v1.0.1
 
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0 // indirect
+)
+
 replace github.com/ojbkgo/socks5-protocol v1.0.1 => ../socks5-protocol
@@ -0,0 +1,385 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+var errConnectionNotAllowed = errors.New("connection not allowed by ruleset")
+
+// 匹配规则时解析目标域名的超时时间
+const aclResolveTimeout = 5 * time.Second
+
+const (
+	aclActionAllow = "allow"
+	aclActionDeny  = "deny"
+)
+
+var aclCommandNames = map[string]socks5.Socks5Cmd{
+	"connect": socks5.Socks5CmdConnect,
+	"bind":    socks5.Socks5CmdBind,
+	"udp":     socks5.Socks5CmdUdpAssociate,
+}
+
+// ACL 按规则顺序匹配, 第一条匹配的规则决定是否放行, 都不匹配时:
+// DenyPrivate 为 true 且目标为内网/本机/链路本地地址时拒绝, 否则按 Default 处理 (默认 allow)
+//
+// 配置文件为 json, 例如:
+//
+//	{
+//	  "default": "allow",
+//	  "deny_private": true,
+//	  "rules": [
+//	    {"action": "allow", "users": ["admin"], "networks": ["10.0.0.0/8"]},
+//	    {"action": "deny", "domain_suffixes": ["example.com"], "ports": ["1-1023"]}
+//	  ]
+//	}
+type ACL struct {
+	Default     string     `json:"default"`
+	DenyPrivate bool       `json:"deny_private"`
+	Rules       []*ACLRule `json:"rules"`
+}
+
+type ACLRule struct {
+	Action string `json:"action"`
+	RuleMatch
+}
+
+// RuleMatch 规则的匹配条件, 设置了的条件需全部满足, 同一条件内任意一项满足即可;
+// 目标地址的 Networks/Domains/DomainSuffixes/DomainRegexps 视为同一个条件
+type RuleMatch struct {
+	// connect, bind, udp
+	Commands []string `json:"commands,omitempty"`
+	// 认证后的用户名
+	Users []string `json:"users,omitempty"`
+	// 客户端地址, cidr 或 ip
+	Sources []string `json:"sources,omitempty"`
+	// 目标地址, cidr 或 ip, 目标为域名时匹配解析后的地址
+	Networks []string `json:"networks,omitempty"`
+	// 目标域名完全匹配
+	Domains []string `json:"domains,omitempty"`
+	// 目标域名后缀匹配, "example.com" 匹配 example.com 及其子域名
+	DomainSuffixes []string `json:"domain_suffixes,omitempty"`
+	DomainRegexps  []string `json:"domain_regexps,omitempty"`
+	// 目标端口, "443" 或 "8000-9000"
+	Ports []string `json:"ports,omitempty"`
+
+	commands []socks5.Socks5Cmd
+	sources  []*net.IPNet
+	networks []*net.IPNet
+	regexps  []*regexp.Regexp
+	ports    [][2]uint16
+}
+
+// aclRequest 一次访问请求, 目标为域名时 ips 为解析结果
+type aclRequest struct {
+	cmd      socks5.Socks5Cmd
+	source   net.IP
+	username string
+	host     string
+	ips      []net.IP
+	port     uint16
+}
+
+// 除 IsPrivate/IsLoopback 等之外额外视为内网的地址, 100.64.0.0/10 为运营商 NAT, 部分云厂商的元数据服务在其中
+var extraPrivateNetworks = mustParseCIDRs("100.64.0.0/10")
+
+func LoadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ACL{}
+	if err := json.Unmarshal(data, acl); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := acl.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return acl, nil
+}
+
+// Compile 校验并预处理规则, 手动构造的 ACL 需调用后才能使用
+func (a *ACL) Compile() error {
+	if a.Default != "" && a.Default != aclActionAllow && a.Default != aclActionDeny {
+		return fmt.Errorf("invalid default action: %s", a.Default)
+	}
+
+	for i, rule := range a.Rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// needResolve 是否需要解析域名才能判断
+func (a *ACL) needResolve() bool {
+	if a.DenyPrivate {
+		return true
+	}
+
+	for _, rule := range a.Rules {
+		if len(rule.networks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) allow(req *aclRequest) bool {
+	for _, rule := range a.Rules {
+		if rule.match(req) {
+			return rule.Action == aclActionAllow
+		}
+	}
+
+	if a.DenyPrivate {
+		for _, ip := range req.ips {
+			if isPrivateIP(ip) {
+				return false
+			}
+		}
+	}
+
+	return a.Default != aclActionDeny
+}
+
+func (r *ACLRule) compile() error {
+	if r.Action != aclActionAllow && r.Action != aclActionDeny {
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	return r.RuleMatch.compile()
+}
+
+func (r *RuleMatch) compile() error {
+	r.commands = nil
+	for _, name := range r.Commands {
+		cmd, ok := aclCommandNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("invalid command: %s", name)
+		}
+		r.commands = append(r.commands, cmd)
+	}
+
+	var err error
+	if r.sources, err = parseCIDRs(r.Sources); err != nil {
+		return err
+	}
+	if r.networks, err = parseCIDRs(r.Networks); err != nil {
+		return err
+	}
+
+	r.regexps = nil
+	for _, expr := range r.DomainRegexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		r.regexps = append(r.regexps, re)
+	}
+
+	r.ports = nil
+	for _, p := range r.Ports {
+		portRange, err := parsePortRange(p)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, portRange)
+	}
+
+	return nil
+}
+
+func (r *RuleMatch) match(req *aclRequest) bool {
+	if len(r.commands) > 0 && !r.matchCommand(req.cmd) {
+		return false
+	}
+
+	if len(r.Users) > 0 && !r.matchUser(req.username) {
+		return false
+	}
+
+	if len(r.sources) > 0 && !matchNetworks(r.sources, req.source) {
+		return false
+	}
+
+	if len(r.ports) > 0 && !r.matchPort(req.port) {
+		return false
+	}
+
+	if r.hasDestination() && !r.matchDestination(req) {
+		return false
+	}
+
+	return true
+}
+
+func (r *RuleMatch) matchCommand(cmd socks5.Socks5Cmd) bool {
+	for _, c := range r.commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RuleMatch) matchUser(username string) bool {
+	for _, u := range r.Users {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RuleMatch) matchPort(port uint16) bool {
+	for _, p := range r.ports {
+		if port >= p[0] && port <= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RuleMatch) hasDestination() bool {
+	return len(r.networks) > 0 || len(r.Domains) > 0 || len(r.DomainSuffixes) > 0 || len(r.regexps) > 0
+}
+
+func (r *RuleMatch) matchDestination(req *aclRequest) bool {
+	for _, ip := range req.ips {
+		if matchNetworks(r.networks, ip) {
+			return true
+		}
+	}
+
+	if req.host == "" {
+		return false
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(req.host, "."))
+	for _, d := range r.Domains {
+		if host == strings.ToLower(d) {
+			return true
+		}
+	}
+
+	for _, suffix := range r.DomainSuffixes {
+		suffix = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(suffix, "*"), "."))
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+
+	for _, re := range r.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupIP 解析规则匹配用的目标地址, 不超过 aclResolveTimeout
+func lookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), aclResolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		matchNetworks(extraPrivateNetworks, ip)
+}
+
+// parseCIDRs 解析 cidr 列表, 单个 ip 视为 /32 或 /128
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func mustParseCIDRs(list ...string) []*net.IPNet {
+	networks, err := parseCIDRs(list)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// parsePortRange 解析 "443" 或 "8000-9000"
+func parsePortRange(s string) ([2]uint16, error) {
+	start, end, found := strings.Cut(strings.TrimSpace(s), "-")
+	if !found {
+		end = start
+	}
+
+	from, err := strconv.ParseUint(strings.TrimSpace(start), 10, 16)
+	if err != nil {
+		return [2]uint16{}, fmt.Errorf("invalid port: %s", s)
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(end), 10, 16)
+	if err != nil || to < from {
+		return [2]uint16{}, fmt.Errorf("invalid port: %s", s)
+	}
+
+	return [2]uint16{uint16(from), uint16(to)}, nil
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+func mustCompileACL(t *testing.T, acl *ACL) *ACL {
+	t.Helper()
+
+	if err := acl.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return acl
+}
+
+func denyRule(match RuleMatch) *ACLRule {
+	return &ACLRule{Action: aclActionDeny, RuleMatch: match}
+}
+
+func allowRule(match RuleMatch) *ACLRule {
+	return &ACLRule{Action: aclActionAllow, RuleMatch: match}
+}
+
+func TestACLAllow(t *testing.T) {
+	connect := func(host string, port uint16, ips ...string) *aclRequest {
+		req := &aclRequest{cmd: socks5.Socks5CmdConnect, source: net.ParseIP("192.0.2.1"), host: host, port: port}
+		for _, ip := range ips {
+			req.ips = append(req.ips, net.ParseIP(ip))
+		}
+		return req
+	}
+
+	tests := []struct {
+		name  string
+		acl   *ACL
+		req   *aclRequest
+		allow bool
+	}{
+		// 域名后缀, 支持 "*." 和 "." 前缀
+		{"suffix exact", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{"example.com"}})}}, connect("example.com", 80), false},
+		{"suffix subdomain", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{"example.com"}})}}, connect("a.b.example.com", 80), false},
+		{"suffix case and root dot", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{"Example.COM"}})}}, connect("WWW.example.com.", 80), false},
+		{"suffix not partial label", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{"example.com"}})}}, connect("badexample.com", 80), true},
+		{"suffix star prefix", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{"*.example.com"}})}}, connect("www.example.com", 80), false},
+		{"suffix star prefix apex", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{"*.example.com"}})}}, connect("example.com", 80), false},
+		{"suffix dot prefix", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{".example.com"}})}}, connect("www.example.com", 80), false},
+		{"suffix dot prefix other", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainSuffixes: []string{".example.com"}})}}, connect("example.org", 80), true},
+		{"domain exact only", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Domains: []string{"example.com"}})}}, connect("www.example.com", 80), true},
+
+		// 正则不锚定, 匹配域名的任意部分
+		{"regexp unanchored", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainRegexps: []string{`ads?\.`}})}}, connect("cdn.ads.example.com", 80), false},
+		{"regexp anchored", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainRegexps: []string{`^ads\.`}})}}, connect("cdn.ads.example.com", 80), true},
+		{"regexp no host", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{DomainRegexps: []string{`.*`}})}}, connect("", 80, "192.0.2.10"), true},
+
+		// 端口范围包含两端
+		{"port range start", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"8000-9000"}})}}, connect("example.com", 8000), false},
+		{"port range end", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"8000-9000"}})}}, connect("example.com", 9000), false},
+		{"port range outside", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"8000-9000"}})}}, connect("example.com", 9001), true},
+		{"port single", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"22", "25"}})}}, connect("example.com", 25), false},
+		{"port and domain", &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"25"}, DomainSuffixes: []string{"example.com"}})}}, connect("example.org", 25), true},
+
+		// 第一条匹配的规则生效
+		{"first match allow", &ACL{Default: aclActionDeny, Rules: []*ACLRule{
+			allowRule(RuleMatch{Domains: []string{"www.example.com"}}),
+			denyRule(RuleMatch{DomainSuffixes: []string{"example.com"}}),
+		}}, connect("www.example.com", 443), true},
+		{"first match deny", &ACL{Rules: []*ACLRule{
+			denyRule(RuleMatch{DomainSuffixes: []string{"example.com"}}),
+			allowRule(RuleMatch{Domains: []string{"www.example.com"}}),
+		}}, connect("www.example.com", 443), false},
+		{"default deny", &ACL{Default: aclActionDeny, Rules: []*ACLRule{
+			allowRule(RuleMatch{Domains: []string{"www.example.com"}}),
+		}}, connect("example.org", 443), false},
+		{"rule before deny private", &ACL{DenyPrivate: true, Rules: []*ACLRule{
+			allowRule(RuleMatch{Networks: []string{"10.0.0.0/8"}}),
+		}}, connect("", 80, "10.1.2.3"), true},
+		{"command and user", &ACL{Rules: []*ACLRule{
+			denyRule(RuleMatch{Commands: []string{"connect"}, Users: []string{"bob"}}),
+		}}, connect("example.com", 80), true},
+
+		// 内网, 本机, 链路本地, 运营商 NAT, 映射地址和 ipv6 ula
+		{"private loopback", &ACL{DenyPrivate: true}, connect("", 80, "127.0.0.2"), false},
+		{"private metadata", &ACL{DenyPrivate: true}, connect("", 80, "169.254.169.254"), false},
+		{"private cgnat", &ACL{DenyPrivate: true}, connect("", 80, "100.64.0.1"), false},
+		{"private cgnat end", &ACL{DenyPrivate: true}, connect("", 80, "100.127.255.254"), false},
+		{"private mapped metadata", &ACL{DenyPrivate: true}, connect("", 80, "::ffff:169.254.169.254"), false},
+		{"private ula", &ACL{DenyPrivate: true}, connect("", 80, "fd00::1"), false},
+		{"private ula fc", &ACL{DenyPrivate: true}, connect("", 80, "fc00::1"), false},
+		{"private ipv6 loopback", &ACL{DenyPrivate: true}, connect("", 80, "::1"), false},
+		{"private any resolved", &ACL{DenyPrivate: true}, connect("example.com", 80, "93.184.216.34", "10.0.0.1"), false},
+		{"public", &ACL{DenyPrivate: true}, connect("", 80, "93.184.216.34"), true},
+		{"public cgnat neighbour", &ACL{DenyPrivate: true}, connect("", 80, "100.128.0.1"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := mustCompileACL(t, tt.acl)
+			if allow := acl.allow(tt.req); allow != tt.allow {
+				t.Fatalf("allow: %v, want %v", allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestACLCompileError(t *testing.T) {
+	for _, acl := range []*ACL{
+		{Default: "maybe"},
+		{Rules: []*ACLRule{{Action: "block"}}},
+		{Rules: []*ACLRule{denyRule(RuleMatch{Commands: []string{"listen"}})}},
+		{Rules: []*ACLRule{denyRule(RuleMatch{Networks: []string{"10.0.0.0/33"}})}},
+		{Rules: []*ACLRule{denyRule(RuleMatch{DomainRegexps: []string{"("}})}},
+		{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"9000-8000"}})}},
+		{Rules: []*ACLRule{denyRule(RuleMatch{Ports: []string{"65536"}})}},
+	} {
+		if err := acl.Compile(); err == nil {
+			t.Fatalf("compile succeeded: %+v", acl.Rules)
+		}
+	}
+}
+
+// 域名解析失败时按域名规则判断, 被拒绝的域名返回 not allowed, 否则返回解析错误
+func TestCheckACLResolveFailure(t *testing.T) {
+	acl := mustCompileACL(t, &ACL{DenyPrivate: true, Rules: []*ACLRule{
+		denyRule(RuleMatch{DomainSuffixes: []string{"denied.invalid"}}),
+	}})
+	s := NewServer(&ServerConfig{ACL: acl})
+
+	_, err := s.checkACL(&aclRequest{cmd: socks5.Socks5CmdConnect, host: "www.denied.invalid", port: 80})
+	if !errors.Is(err, errConnectionNotAllowed) {
+		t.Fatalf("denied domain: %v", err)
+	}
+
+	_, err = s.checkACL(&aclRequest{cmd: socks5.Socks5CmdConnect, host: "allowed.invalid", port: 80})
+	if err == nil || errors.Is(err, errConnectionNotAllowed) {
+		t.Fatalf("allowed domain: %v", err)
+	}
+}
+
+// 被规则拒绝的 CONNECT 应答 connection not allowed
+func TestServerACLDenied(t *testing.T) {
+	acl := mustCompileACL(t, &ACL{DenyPrivate: true})
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, ACL: acl})
+	echo := startEchoServer(t)
+
+	conn, _ := dialSocks5(t, addr)
+	defer conn.Close()
+
+	if resp := socks5Request(t, conn, socks5.Socks5CmdConnect, echo); resp.Rep != socks5.Socks5RepConnectionNotAllowed {
+		t.Fatalf("connect reply: %d, want %d", resp.Rep, socks5.Socks5RepConnectionNotAllowed)
+	}
+}
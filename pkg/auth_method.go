@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+var authMethodNames = map[string]socks5.Socks5Method{
+	"noauth":   socks5.Socks5MethodNoAuth,
+	"gssapi":   socks5.Socks5MethodGssapi,
+	"userpass": socks5.Socks5MethodUserPass,
+}
+
+// ParseAuthMethods 解析逗号分隔的认证方式, 支持名称 (noauth, userpass) 或数字
+func ParseAuthMethods(s string) ([]socks5.Socks5Method, error) {
+	var methods []socks5.Socks5Method
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if m, ok := authMethodNames[name]; ok {
+			methods = append(methods, m)
+			continue
+		}
+
+		n, err := strconv.ParseUint(name, 0, 8)
+		if err != nil || socks5.Socks5Method(n) == socks5.Socks5MethodNoAcceptable {
+			return nil, fmt.Errorf("invalid auth method: %s", name)
+		}
+		methods = append(methods, socks5.Socks5Method(n))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no auth method in %q", s)
+	}
+	return methods, nil
+}
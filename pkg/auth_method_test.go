@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+func TestParseAuthMethods(t *testing.T) {
+	methods, err := ParseAuthMethods("userpass, NoAuth,0x80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []socks5.Socks5Method{socks5.Socks5MethodUserPass, socks5.Socks5MethodNoAuth, 0x80}
+	if !reflect.DeepEqual(methods, want) {
+		t.Fatalf("methods: %v, want %v", methods, want)
+	}
+
+	for _, s := range []string{"", " , ", "kerberos", "0xff", "256"} {
+		if _, err := ParseAuthMethods(s); err == nil {
+			t.Fatalf("parsed %q", s)
+		}
+	}
+}
+
+// 客户端提供的认证方式都不被支持时应答 0xFF 并关闭连接
+func TestServerNoAcceptableMethod(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethods: []socks5.Socks5Method{socks5.Socks5MethodUserPass}})
+
+	conn, method := dialSocks5(t, addr, socks5.Socks5MethodNoAuth, socks5.Socks5MethodGssapi)
+	defer conn.Close()
+	if method != socks5.Socks5MethodNoAcceptable {
+		t.Fatalf("method: %d, want %d", method, socks5.Socks5MethodNoAcceptable)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after 0xFF: %v, want EOF", err)
+	}
+}
+
+// 按服务端配置的顺序选择, 而不是客户端提供的顺序
+func TestServerAuthMethodPreference(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []socks5.Socks5Method{socks5.Socks5MethodUserPass, socks5.Socks5MethodNoAuth},
+	})
+
+	conn, method := dialSocks5(t, addr, socks5.Socks5MethodNoAuth, socks5.Socks5MethodUserPass)
+	defer conn.Close()
+	if method != socks5.Socks5MethodUserPass {
+		t.Fatalf("method: %d, want %d", method, socks5.Socks5MethodUserPass)
+	}
+}
+
+func TestServerAuthPolicy(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name     string
+		policies []AuthPolicy
+		want     socks5.Socks5Method
+	}{
+		{
+			name:     "matched",
+			policies: []AuthPolicy{{Network: loopback, Methods: []socks5.Socks5Method{socks5.Socks5MethodNoAuth}}},
+			want:     socks5.Socks5MethodNoAuth,
+		},
+		{
+			name:     "not matched",
+			policies: []AuthPolicy{{Network: private, Methods: []socks5.Socks5Method{socks5.Socks5MethodNoAuth}}},
+			want:     socks5.Socks5MethodUserPass,
+		},
+		{
+			// 匹配到的策略里没有客户端支持的方式时不回退到默认方式
+			name:     "matched without offered method",
+			policies: []AuthPolicy{{Network: loopback, Methods: []socks5.Socks5Method{socks5.Socks5MethodGssapi}}},
+			want:     socks5.Socks5MethodNoAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		addr := startTestServer(t, &ServerConfig{
+			AuthMethods:  []socks5.Socks5Method{socks5.Socks5MethodUserPass},
+			AuthPolicies: tt.policies,
+		})
+
+		conn, method := dialSocks5(t, addr, socks5.Socks5MethodNoAuth, socks5.Socks5MethodUserPass)
+		_ = conn.Close()
+		if method != tt.want {
+			t.Errorf("%s: method %d, want %d", tt.name, method, tt.want)
+		}
+	}
+}
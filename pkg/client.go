@@ -1,9 +1,14 @@
 package pkg
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"time"
 
 	socks5 "github.com/ojbkgo/socks5-protocol"
 )
@@ -21,6 +26,51 @@ type ClientConfig struct {
 	Username   string
 	Password   string
 	AuthMethod socks5.Socks5Method
+
+	// 多个服务端, 不为空时 Dialer 按 RemoteStrategy 选择 (默认轮询), 忽略 RemoteAddr/RemotePort;
+	// 连接, tls 或认证失败的服务端按指数退避暂停使用, 建立连接失败时换一个服务端重试
+	RemoteServers  []RemoteServer
+	RemoteStrategy string
+
+	// 握手时按优先级提供的认证方式, 为空时使用 AuthMethod
+	AuthMethods []socks5.Socks5Method
+	// 自定义认证方式, 服务端选中后用于完成子协商
+	AuthHandlers map[socks5.Socks5Method]ClientAuthHandler
+
+	// 不为空时通过 tls 连接服务端, 见 NewClientTLSConfig; ServerName 为空时使用 RemoteAddr
+	TLSConfig *tls.Config
+
+	// 大于 0 时 Dialer 保持最多 MuxSessions 个多路复用会话, 每个 CONNECT 在会话上新建流,
+	// 不再单独握手和认证; 需要服务端开启 ServerConfig.Mux
+	MuxSessions int
+
+	// 大于 0 时 Dialer 保持 PoolSize 个已完成握手和认证的空闲连接, CONNECT 时直接取用并在后台补充;
+	// 开启多路复用时不使用
+	PoolSize int
+	// 空闲连接超过该时间未被取用时关闭, 为 0 时使用 defaultPoolIdleTimeout
+	PoolIdleTimeout time.Duration
+	// 空闲连接从建立起的最长存活时间, 为 0 时不限制
+	PoolMaxLifetime time.Duration
+}
+
+// ClientAuthHandler 完成某种认证方式在客户端的子协商
+type ClientAuthHandler func(conn net.Conn) error
+
+var (
+	// ErrNoAcceptableMethod 服务端不接受客户端提供的任何认证方式
+	ErrNoAcceptableMethod = errors.New("no acceptable auth method")
+	// ErrAuthFailed 服务端认证失败
+	ErrAuthFailed = errors.New("auth failed")
+)
+
+// ReplyError 服务端应答命令失败, Rep 为应答码 (如目标拒绝连接, 访问规则不允许)
+type ReplyError struct {
+	Cmd socks5.Socks5Cmd
+	Rep socks5.Socks5Rep
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%s failed: %s", cmdName(e.Cmd), socks5.GetRepMessage(e.Rep))
 }
 
 func NewClient(config *ClientConfig) *client {
@@ -32,11 +82,40 @@ func NewClient(config *ClientConfig) *client {
 
 func (c *client) Open() error {
 	// dial
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.config.RemoteAddr, c.config.RemotePort))
+	conn, err := net.Dial("tcp", net.JoinHostPort(c.config.RemoteAddr, strconv.Itoa(c.config.RemotePort)))
 	if err != nil {
 		return err
 	}
 
+	if conn, err = c.wrapTLS(context.Background(), conn); err != nil {
+		return err
+	}
+
+	return c.openConn(conn)
+}
+
+// wrapTLS 配置了 tls 时在 conn 上完成 tls 握手, 失败时关闭连接
+func (c *client) wrapTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if c.config.TLSConfig == nil {
+		return conn, nil
+	}
+
+	config := c.config.TLSConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = c.config.RemoteAddr
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// openConn 在已建立的连接上完成握手和认证, 失败时关闭连接
+func (c *client) openConn(conn net.Conn) error {
 	c.conn = conn
 
 	// handshake
@@ -46,7 +125,7 @@ func (c *client) Open() error {
 	}
 
 	// auth
-	if err := c.authUserPassword(); err != nil {
+	if err := c.authenticate(); err != nil {
 		log.Printf("auth failed: %v", err)
 		_ = conn.Close()
 		return err
@@ -68,10 +147,12 @@ func (c *client) Recv() error {
 }
 
 func (c *client) handshake() error {
+	methods := c.authMethods()
+
 	req := &socks5.HandshakeReq{}
 	req.Ver = socks5.Socks5Version5
-	req.NMethods = 1
-	req.Methods = []socks5.Socks5Method{socks5.Socks5MethodUserPass}
+	req.NMethods = uint8(len(methods))
+	req.Methods = methods
 
 	_, err := c.conn.Write(req.Serialize())
 	if err != nil {
@@ -83,14 +164,23 @@ func (c *client) handshake() error {
 		return err
 	}
 
-	fmt.Printf("resp: %v\n", resp)
-
 	if resp.Ver != socks5.Socks5Version5 {
 		return fmt.Errorf("socks version not support")
 	}
 
-	if resp.Method != socks5.Socks5MethodUserPass {
-		return fmt.Errorf("auth method not support")
+	if resp.Method == socks5.Socks5MethodNoAcceptable {
+		return ErrNoAcceptableMethod
+	}
+
+	var offered bool
+	for _, m := range methods {
+		if m == resp.Method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		return fmt.Errorf("auth method not offered: %d", resp.Method)
 	}
 
 	c.authMethod = resp.Method
@@ -100,6 +190,35 @@ func (c *client) handshake() error {
 	return nil
 }
 
+// authMethods 返回握手时提供的认证方式
+func (c *client) authMethods() []socks5.Socks5Method {
+	if len(c.config.AuthMethods) > 0 {
+		return c.config.AuthMethods
+	}
+
+	// 只设置了 AuthMethod 时, 有用户名则同时提供用户名密码认证
+	methods := []socks5.Socks5Method{c.config.AuthMethod}
+	if c.config.Username != "" && c.config.AuthMethod != socks5.Socks5MethodUserPass {
+		methods = append(methods, socks5.Socks5MethodUserPass)
+	}
+	return methods
+}
+
+// authenticate 按服务端选择的认证方式完成认证
+func (c *client) authenticate() error {
+	switch c.authMethod {
+	case socks5.Socks5MethodNoAuth:
+		return nil
+	case socks5.Socks5MethodUserPass:
+		return c.authUserPassword()
+	}
+
+	if handler, ok := c.config.AuthHandlers[c.authMethod]; ok {
+		return handler(c.conn)
+	}
+	return fmt.Errorf("auth method not support: %d", c.authMethod)
+}
+
 func (c *client) authUserPassword() error {
 	req := &socks5.AuthUserPasswordReq{}
 	req.Ver = 0x01
@@ -108,8 +227,6 @@ func (c *client) authUserPassword() error {
 	req.Plen = uint8(len(c.config.Password))
 	req.Passwd = c.config.Password
 
-	fmt.Printf("req: %v\n", req)
-
 	err := req.WriteIO(c.conn)
 	if err != nil {
 		return err
@@ -125,7 +242,7 @@ func (c *client) authUserPassword() error {
 	}
 
 	if resp.Status != 0 {
-		return fmt.Errorf("auth failed")
+		return ErrAuthFailed
 	}
 
 	c.logger.Printf("auth success, username: %s", c.config.Username)
@@ -134,73 +251,107 @@ func (c *client) authUserPassword() error {
 }
 
 func (c *client) ConnectDomain(addr string, port int) error {
+	return c.connect(socks5.Socks5AddrTypeDomainName, addr, port)
+}
+
+func (c *client) ConnectIPV4(addr string, port int) error {
+	return c.connect(socks5.Socks5AddrTypeIPv4, addr, port)
+}
+
+func (c *client) ConnectIPV6(addr string, port int) error {
+	return c.connect(socks5.Socks5AddrTypeIPv6, addr, port)
+}
+
+// connectHost 按 host 的格式选择地址类型
+func (c *client) connectHost(host string, port int) error {
+	return c.connect(socks5AddrTypeOf(host), host, port)
+}
+
+func (c *client) connect(atyp socks5.Socks5AddrType, addr string, port int) error {
+	_, err := c.request(socks5.Socks5CmdConnect, atyp, addr, port)
+	return err
+}
+
+// request 发送命令请求并读取应答
+func (c *client) request(cmd socks5.Socks5Cmd, atyp socks5.Socks5AddrType, addr string, port int) (*socks5.Socks5CmdResponse, error) {
 	req := &socks5.Socks5CmdRequest{}
 	req.Ver = socks5.Socks5Version5
-	req.Cmd = socks5.Socks5CmdConnect
+	req.Cmd = cmd
 	req.Rsv = 0
-	req.Atyp = socks5.Socks5AddrTypeDomainName
+	req.Atyp = atyp
 	req.Addr = socks5.Socks5Addr{
 		Addr: addr,
 		Port: uint16(port),
 	}
 
-	err := req.WriteIO(c.conn)
+	err := writeCmdRequest(c.conn, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp := &socks5.Socks5CmdResponse{}
-	if err := resp.ReadIO(c.conn); err != nil {
-		return err
+	return c.readResponse(cmd)
+}
+
+func (c *client) readResponse(cmd socks5.Socks5Cmd) (*socks5.Socks5CmdResponse, error) {
+	resp, err := readCmdResponse(c.conn)
+	if err != nil {
+		return nil, err
 	}
 
 	if resp.Ver != socks5.Socks5Version5 {
-		return fmt.Errorf("socks version not support")
+		return nil, fmt.Errorf("socks version not support")
 	}
 
 	if resp.Rep != socks5.Socks5RepSuccess {
-		return fmt.Errorf("connect failed: " + socks5.GetRepMessage(resp.Rep))
+		return nil, &ReplyError{Cmd: cmd, Rep: resp.Rep}
 	}
 
-	return nil
+	return resp, nil
 }
 
-func (c *client) ConnectIPV4(addr string, port int) error {
-	req := &socks5.Socks5CmdRequest{}
-	req.Ver = socks5.Socks5Version5
-	req.Cmd = socks5.Socks5CmdConnect
-	req.Rsv = 0
-	req.Atyp = socks5.Socks5AddrTypeIPv4
-	req.Addr = socks5.Socks5Addr{
-		Addr: addr,
-		Port: uint16(port),
+func cmdName(cmd socks5.Socks5Cmd) string {
+	switch cmd {
+	case socks5.Socks5CmdConnect:
+		return "connect"
+	case socks5.Socks5CmdBind:
+		return "bind"
+	case socks5.Socks5CmdUdpAssociate:
+		return "udp associate"
+	case socks5CmdMux:
+		return "mux"
 	}
+	return fmt.Sprintf("cmd %d", cmd)
+}
 
-	err := req.WriteIO(c.conn)
+// udpAssociate 发送 UDP ASSOCIATE, 返回服务端的 udp 中继地址;
+// 客户端经过 NAT 时发出报文的地址未知, 请求中填 0.0.0.0:0
+func (c *client) udpAssociate() (*net.UDPAddr, error) {
+	resp, err := c.request(socks5.Socks5CmdUdpAssociate, socks5.Socks5AddrTypeIPv4, net.IPv4zero.String(), 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp := &socks5.Socks5CmdResponse{}
-	if err := resp.ReadIO(c.conn); err != nil {
-		return err
+	relay, err := net.ResolveUDPAddr("udp", socks5HostPort(resp.Addr))
+	if err != nil {
+		return nil, err
 	}
 
-	if resp.Ver != socks5.Socks5Version5 {
-		return fmt.Errorf("socks version not support")
+	// 服务端监听在全零地址时使用控制连接的地址
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if tcpAddr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		}
 	}
 
-	if resp.Rep != socks5.Socks5RepSuccess {
-		return fmt.Errorf("connect failed: " + socks5.GetRepMessage(resp.Rep))
-	}
-
-	return nil
+	return relay, nil
 }
 
-func (c *client) udpAssociate() error {
-	return nil
+// bind 发送 BIND, 返回第一次应答中服务端的监听地址, addr 为期望连入的对端地址
+func (c *client) bind(atyp socks5.Socks5AddrType, addr string, port int) (*socks5.Socks5CmdResponse, error) {
+	return c.request(socks5.Socks5CmdBind, atyp, addr, port)
 }
 
-func (c *client) bind() error {
-	return nil
+// bindAccept 等待 BIND 的第二次应答, 返回连入的对端地址
+func (c *client) bindAccept() (*socks5.Socks5CmdResponse, error) {
+	return c.readResponse(socks5.Socks5CmdBind)
 }
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"net"
+	"sync"
+)
+
+// bindListener 只接受一个连接的 net.Listener, Addr 为服务端为 BIND 监听的地址,
+// Accept 等待第二次应答后返回控制连接本身, 之后再 Accept 返回 net.ErrClosed
+type bindListener struct {
+	cli  *client
+	addr net.Addr
+
+	mu       sync.Mutex
+	accepted bool
+	// 连接已交给调用方, Close 时不再关闭
+	handedOff bool
+}
+
+func (l *bindListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.accepted {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	l.accepted = true
+	l.mu.Unlock()
+
+	resp, err := l.cli.bindAccept()
+	if err != nil {
+		_ = l.cli.conn.Close()
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.handedOff = true
+	l.mu.Unlock()
+
+	return &bindConn{
+		Conn:   l.cli.conn,
+		remote: socks5NetAddrOf("tcp", resp.Atyp, resp.Addr),
+	}, nil
+}
+
+func (l *bindListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.accepted = true
+	if l.handedOff {
+		return nil
+	}
+	return l.cli.conn.Close()
+}
+
+func (l *bindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bindConn RemoteAddr 返回连入的对端地址而不是 socks5 服务端地址
+type bindConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// muxPool 客户端到服务端的多路复用会话, 会话数不足 size 时在后台新建会话, 在流最少的会话上新建流
+type muxPool struct {
+	dialer *Dialer
+	size   int
+
+	mu       sync.Mutex
+	sessions []*muxSession
+	// 正在新建的会话, 同一时间只新建一个
+	dialing *muxDial
+}
+
+// muxDial 一次新建会话, 完成时关闭 done
+type muxDial struct {
+	done chan struct{}
+	err  error
+}
+
+func newMuxPool(dialer *Dialer, size int) *muxPool {
+	return &muxPool{dialer: dialer, size: size}
+}
+
+// openStream 新建流, 会话已断开时换一个会话重试一次
+func (p *muxPool) openStream(ctx context.Context) (*muxStream, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		var sess *muxSession
+		if sess, err = p.session(ctx); err != nil {
+			return nil, err
+		}
+
+		var stream *muxStream
+		if stream, err = sess.openStream(); err == nil {
+			return stream, nil
+		}
+	}
+	return nil, err
+}
+
+// session 选择流最少的会话, 会话数不足时在后台新建; 没有可用会话时等待新建完成, 受 ctx 控制
+func (p *muxPool) session(ctx context.Context) (*muxSession, error) {
+	for {
+		p.mu.Lock()
+		alive := p.sessions[:0]
+		for _, sess := range p.sessions {
+			if !sess.isClosed() {
+				alive = append(alive, sess)
+			}
+		}
+		p.sessions = alive
+
+		if len(p.sessions) < p.size && p.dialing == nil {
+			p.dialing = &muxDial{done: make(chan struct{})}
+			go p.dialSession(p.dialing)
+		}
+
+		if len(p.sessions) > 0 {
+			best := p.sessions[0]
+			for _, sess := range p.sessions[1:] {
+				if sess.numStreams() < best.numStreams() {
+					best = sess
+				}
+			}
+			p.mu.Unlock()
+			return best, nil
+		}
+
+		dialing := p.dialing
+		p.mu.Unlock()
+
+		select {
+		case <-dialing.done:
+			if dialing.err != nil {
+				return nil, dialing.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialSession 新建会话, 使用单独的超时时间, 不受发起请求的 ctx 影响
+func (p *muxPool) dialSession(dialing *muxDial) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	conn, err := p.dialer.dial(ctx, func(cli *client) error {
+		_, err := cli.request(socks5CmdMux, socks5.Socks5AddrTypeIPv4, "0.0.0.0", 0)
+		return err
+	})
+
+	p.mu.Lock()
+	if err == nil {
+		p.sessions = append(p.sessions, newMuxSession(conn, true, 0))
+	}
+	dialing.err = err
+	p.dialing = nil
+	p.mu.Unlock()
+
+	close(dialing.done)
+}
+
+func (p *muxPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, sess := range p.sessions {
+		_ = sess.close()
+	}
+	p.sessions = nil
+}
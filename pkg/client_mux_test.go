@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+func TestMuxStreams(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, Mux: true})
+	echo := startEchoServer(t)
+
+	config := testClientConfig(t, addr)
+	config.MuxSessions = 2
+	d := NewDialer(config)
+	defer d.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := d.Dial("tcp", echo)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			// 超过流控窗口, 需要对端归还额度才能发完
+			data := make([]byte, 2*muxWindowSize)
+			_, _ = rand.Read(data)
+			go func() {
+				_, _ = conn.Write(data)
+			}()
+
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("echo data mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// 服务端不支持多路复用时按普通方式连接
+func TestMuxFallback(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	config := testClientConfig(t, addr)
+	config.MuxSessions = 1
+	d := NewDialer(config)
+	defer d.Close()
+
+	conn, err := d.Dial("tcp", startEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	echoRoundTrip(t, conn, "ping")
+	if _, ok := conn.(*muxStream); ok {
+		t.Fatal("fallback conn is a mux stream")
+	}
+}
+
+// 服务端应答 CONNECT 失败时原样返回应答码, 不重新连接服务端
+func TestDialReplyErrorNoFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	_ = l.Close()
+
+	acl := mustCompileACL(t, &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Domains: []string{"denied.example"}})}})
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, Mux: true, ACL: acl})
+
+	for _, tt := range []struct {
+		name   string
+		target string
+		rep    socks5.Socks5Rep
+		setup  func(config *ClientConfig)
+	}{
+		{name: "mux refused", target: refused, rep: socks5.Socks5RepConnectionRefused, setup: func(config *ClientConfig) { config.MuxSessions = 1 }},
+		{name: "mux denied", target: "denied.example:443", rep: socks5.Socks5RepConnectionNotAllowed, setup: func(config *ClientConfig) { config.MuxSessions = 1 }},
+		{name: "pool refused", target: refused, rep: socks5.Socks5RepConnectionRefused, setup: func(config *ClientConfig) { config.PoolSize = 1 }},
+		{name: "direct refused", target: refused, rep: socks5.Socks5RepConnectionRefused, setup: func(config *ClientConfig) {}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// 两个服务端, 重新连接时会换另一个
+			relays := []*testRelay{startTestRelay(t, addr), startTestRelay(t, addr)}
+			config := testClientConfig(t, addr)
+			config.RemoteServers = []RemoteServer{relays[0].remoteServer(), relays[1].remoteServer()}
+			tt.setup(config)
+			d := NewDialer(config)
+			defer d.Close()
+
+			if d.pool != nil {
+				// 空闲连接取走后会在后台补充; 停止接受连接, 重新连接时只会得到连接错误
+				waitPoolIdle(t, d.pool, 1)
+				_ = relays[0].l.Close()
+				_ = relays[1].l.Close()
+			}
+
+			_, err := d.Dial("tcp", tt.target)
+			var replyErr *ReplyError
+			if !errors.As(err, &replyErr) || replyErr.Rep != tt.rep {
+				t.Fatalf("dial error: %v, want reply %d", err, tt.rep)
+			}
+			if d.pool != nil {
+				return
+			}
+			if n := relays[0].accepted.Load() + relays[1].accepted.Load(); n != 1 {
+				t.Fatalf("server connections: %d, want 1", n)
+			}
+		})
+	}
+}
+
+// 新建会话卡住时, 其他请求仍按自己的 ctx 返回
+func TestMuxPoolDialDoesNotBlock(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := testClientConfig(t, l.Addr().String())
+	config.MuxSessions = 1
+	d := NewDialer(config)
+
+	go func() {
+		_, _ = d.Dial("tcp", "example.com:80")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); err == nil {
+		t.Fatal("dial succeeded on hanging server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial blocked for %v", elapsed)
+	}
+}
@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolIdleTimeout = time.Minute
+	// 定时清理过期的空闲连接并补充
+	poolCheckInterval = 10 * time.Second
+	// 取用前检查连接是否已被服务端关闭的等待时间
+	poolValidateTimeout = time.Millisecond
+)
+
+// connPool 预先完成握手和认证 (尚未发送命令) 的空闲连接, 取走的连接不再归还, 后台补充到 size 个
+type connPool struct {
+	dialer      *Dialer
+	size        int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	mu     sync.Mutex
+	idle   []*pooledConn
+	closed bool
+
+	refillCh chan struct{}
+	stopCh   chan struct{}
+}
+
+type pooledConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+func newConnPool(dialer *Dialer, config *ClientConfig) *connPool {
+	p := &connPool{
+		dialer:      dialer,
+		size:        config.PoolSize,
+		idleTimeout: config.PoolIdleTimeout,
+		maxLifetime: config.PoolMaxLifetime,
+		refillCh:    make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = defaultPoolIdleTimeout
+	}
+
+	go p.run()
+	return p
+}
+
+// get 取出一个可用的空闲连接, 没有时返回 nil
+func (p *connPool) get() net.Conn {
+	defer notifyEvent(p.refillCh)
+
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		// 优先取最新建立的连接
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if !p.expired(pc, time.Now()) && pc.alive() {
+			return pc.conn
+		}
+		_ = pc.conn.Close()
+	}
+}
+
+func (p *connPool) run() {
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.prune()
+		p.fill()
+
+		select {
+		case <-p.refillCh:
+		case <-ticker.C:
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// prune 关闭空闲太久或超过最长存活时间的连接
+func (p *connPool) prune() {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := p.idle[:0]
+	for _, pc := range p.idle {
+		if p.expired(pc, now) {
+			_ = pc.conn.Close()
+			continue
+		}
+		idle = append(idle, pc)
+	}
+	p.idle = idle
+}
+
+// fill 补充到 size 个空闲连接, 失败时等下次取用或定时检查时再试
+func (p *connPool) fill() {
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		p.mu.Unlock()
+		if n >= p.size {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		conn, err := p.dialer.dial(ctx, nil)
+		cancel()
+		if err != nil {
+			log.Printf("conn pool dial error: %v\n", err)
+			return
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		p.idle = append(p.idle, &pooledConn{conn: conn, created: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// expired 连接取走后不再归还, 空闲时间即建立后的时间
+func (p *connPool) expired(pc *pooledConn, now time.Time) bool {
+	age := now.Sub(pc.created)
+	return age > p.idleTimeout || (p.maxLifetime > 0 && age > p.maxLifetime)
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stopCh)
+
+	for _, pc := range p.idle {
+		_ = pc.conn.Close()
+	}
+	p.idle = nil
+}
+
+// alive 发送命令前服务端不会发送数据, 短暂读取超时说明连接仍然可用, 读到 EOF 或数据时丢弃
+func (pc *pooledConn) alive() bool {
+	_ = pc.conn.SetReadDeadline(time.Now().Add(poolValidateTimeout))
+	_, err := pc.conn.Read(make([]byte, 1))
+	_ = pc.conn.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
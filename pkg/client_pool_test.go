@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// testRelay 把连接转发到服务端, 统计连接数, 可以停止接受新连接或断开已有连接
+type testRelay struct {
+	l        net.Listener
+	accepted atomic.Int32
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestRelay(t *testing.T, target string) *testRelay {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRelay{l: l}
+	t.Cleanup(func() {
+		_ = l.Close()
+		r.closeConns()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.accepted.Add(1)
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+
+			r.mu.Lock()
+			r.conns = append(r.conns, conn, upstream)
+			r.mu.Unlock()
+
+			go func() {
+				_, _ = io.Copy(upstream, conn)
+				_ = upstream.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(conn, upstream)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return r
+}
+
+func (r *testRelay) addr() string {
+	return r.l.Addr().String()
+}
+
+func (r *testRelay) remoteServer() RemoteServer {
+	addr := r.l.Addr().(*net.TCPAddr)
+	return RemoteServer{Addr: addr.IP.String(), Port: addr.Port}
+}
+
+func (r *testRelay) closeConns() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, conn := range r.conns {
+		_ = conn.Close()
+	}
+	r.conns = nil
+}
+
+// waitPoolIdle 等待空闲连接数达到 n
+func waitPoolIdle(t *testing.T, p *connPool, n int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		p.mu.Lock()
+		idle := len(p.idle)
+		p.mu.Unlock()
+		if idle == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pool idle conns not %d", n)
+}
+
+// CONNECT 使用预先认证的空闲连接, 不再连接服务端
+func TestConnPoolReuse(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+	echo := startEchoServer(t)
+	relay := startTestRelay(t, addr)
+
+	config := testClientConfig(t, relay.addr())
+	config.AuthMethod = socks5.Socks5MethodUserPass
+	config.Username = "u"
+	config.Password = "p"
+	config.PoolSize = 2
+	d := NewDialer(config)
+	defer d.Close()
+
+	waitPoolIdle(t, d.pool, 2)
+	_ = relay.l.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("dial %d with pooled conn: %v", i, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		echoRoundTrip(t, conn, "pooled")
+		_ = conn.Close()
+	}
+
+	if _, err := d.Dial("tcp", echo); err == nil {
+		t.Fatal("dial succeeded with empty pool and server unreachable")
+	}
+}
+
+// 超过最长存活时间的空闲连接被关闭, 不再取用
+func TestConnPoolMaxLifetime(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	relay := startTestRelay(t, addr)
+
+	config := testClientConfig(t, relay.addr())
+	config.PoolSize = 1
+	config.PoolMaxLifetime = 50 * time.Millisecond
+	d := NewDialer(config)
+	defer d.Close()
+
+	waitPoolIdle(t, d.pool, 1)
+	_ = relay.l.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	d.pool.prune()
+	waitPoolIdle(t, d.pool, 0)
+	if conn := d.pool.get(); conn != nil {
+		t.Fatal("expired conn returned from pool")
+	}
+}
+
+// 服务端已关闭的空闲连接在取用时被丢弃
+func TestConnPoolServerClosed(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	relay := startTestRelay(t, addr)
+
+	config := testClientConfig(t, relay.addr())
+	config.PoolSize = 1
+	d := NewDialer(config)
+	defer d.Close()
+
+	waitPoolIdle(t, d.pool, 1)
+	_ = relay.l.Close()
+	relay.closeConns()
+
+	// 等待连接的关闭到达客户端
+	time.Sleep(50 * time.Millisecond)
+	if conn := d.pool.get(); conn != nil {
+		t.Fatal("closed conn returned from pool")
+	}
+}
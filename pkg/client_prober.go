@@ -0,0 +1,230 @@
+package pkg
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	// 成功率按最近 probeWindow 次探测计算
+	probeWindow = 20
+)
+
+// ProberConfig 探测选项
+type ProberConfig struct {
+	// 探测间隔, 为 0 时使用 defaultProbeInterval
+	Interval time.Duration
+	// 单次探测的超时时间, 为 0 时使用 upstreamTimeout
+	Timeout time.Duration
+	// 不为空时认证后再 CONNECT 到该 host:port, 否则只做握手和认证
+	Target string
+}
+
+// ProbeResult 一个服务端的探测结果
+type ProbeResult struct {
+	Server RemoteServer
+	// 最近一次探测
+	LastProbe time.Time
+	LastError string
+	// 最近一次成功探测的耗时, 包括握手, 认证和 CONNECT
+	RTT time.Duration
+	// 最近 probeWindow 次探测中成功的次数和总次数
+	Successes int
+	Probes    int
+}
+
+// SuccessRate 最近的探测成功率, 没有探测过时为 0
+func (r ProbeResult) SuccessRate() float64 {
+	if r.Probes == 0 {
+		return 0
+	}
+	return float64(r.Successes) / float64(r.Probes)
+}
+
+// prober 后台定时探测 Dialer 的每个服务端, 结果同时用于 Dialer 选择服务端:
+// 握手或认证失败时标记不健康, 成功时恢复并记录耗时
+type prober struct {
+	dialer *Dialer
+	config *ProberConfig
+
+	mu      sync.Mutex
+	results map[*remoteState]*probeState
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+type probeState struct {
+	result ProbeResult
+	// 最近的探测是否成功, 环形缓冲
+	history []bool
+	pos     int
+}
+
+// NewProber config 为空时使用默认选项, 调用 Start 开始探测
+func NewProber(dialer *Dialer, config *ProberConfig) *prober {
+	if config == nil {
+		config = &ProberConfig{}
+	}
+
+	p := &prober{
+		dialer:  dialer,
+		config:  config,
+		results: make(map[*remoteState]*probeState),
+		stopCh:  make(chan struct{}),
+	}
+	for _, r := range dialer.remotes.remotes {
+		p.results[r] = &probeState{result: ProbeResult{Server: r.server}}
+	}
+	return p
+}
+
+// Start 在后台立即探测一次, 之后按间隔探测, 直到 Stop
+func (p *prober) Start() {
+	interval := p.config.Interval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			p.probeAll()
+
+			select {
+			case <-ticker.C:
+			case <-p.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (p *prober) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+}
+
+// Results 按配置顺序返回每个服务端的探测结果
+func (p *prober) Results() []ProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	results := make([]ProbeResult, 0, len(p.results))
+	for _, r := range p.dialer.remotes.remotes {
+		results = append(results, p.results[r].result)
+	}
+	return results
+}
+
+// PublishExpvar 把探测结果发布为 expvar 变量, 通过 /debug/vars 查看; 同一 name 只能发布一次
+func (p *prober) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		type probeVar struct {
+			Server      string  `json:"server"`
+			LastProbe   string  `json:"last_probe"`
+			LastError   string  `json:"last_error,omitempty"`
+			RTTMillis   float64 `json:"rtt_ms"`
+			SuccessRate float64 `json:"success_rate"`
+			Probes      int     `json:"probes"`
+		}
+
+		var vars []probeVar
+		for _, r := range p.Results() {
+			vars = append(vars, probeVar{
+				Server:      r.Server.String(),
+				LastProbe:   r.LastProbe.Format(time.RFC3339),
+				LastError:   r.LastError,
+				RTTMillis:   float64(r.RTT) / float64(time.Millisecond),
+				SuccessRate: r.SuccessRate(),
+				Probes:      r.Probes,
+			})
+		}
+		return vars
+	}))
+}
+
+func (p *prober) probeAll() {
+	var wg sync.WaitGroup
+	for _, r := range p.dialer.remotes.remotes {
+		wg.Add(1)
+		go func(r *remoteState) {
+			defer wg.Done()
+			p.probe(r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (p *prober) probe(r *remoteState) {
+	timeout := p.config.Timeout
+	if timeout <= 0 {
+		timeout = upstreamTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var fn func(cli *client) error
+	if p.config.Target != "" {
+		fn = func(cli *client) error {
+			host, portStr, err := net.SplitHostPort(p.config.Target)
+			if err != nil {
+				return err
+			}
+			port, err := net.LookupPort("tcp", portStr)
+			if err != nil {
+				return err
+			}
+			return cli.connectHost(host, port)
+		}
+	}
+
+	start := time.Now()
+	conn, err := p.dialer.dialRemote(ctx, r, fn)
+	rtt := time.Since(start)
+	if err == nil {
+		_ = conn.Close()
+	}
+
+	p.record(r, start, rtt, err)
+}
+
+func (p *prober) record(r *remoteState, at time.Time, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.results[r]
+	if len(st.history) < probeWindow {
+		st.history = append(st.history, err == nil)
+	} else {
+		st.history[st.pos] = err == nil
+		st.pos = (st.pos + 1) % probeWindow
+	}
+
+	res := &st.result
+	res.LastProbe = at
+	res.Probes = len(st.history)
+	res.Successes = 0
+	for _, ok := range st.history {
+		if ok {
+			res.Successes++
+		}
+	}
+
+	if err != nil {
+		res.LastError = err.Error()
+		log.Printf("probe %s failed: %v, success rate: %.0f%%\n", r.server, err, res.SuccessRate()*100)
+		return
+	}
+	res.LastError = ""
+	res.RTT = rtt
+	log.Printf("probe %s ok, rtt: %v, success rate: %.0f%%\n", r.server, rtt, res.SuccessRate()*100)
+}
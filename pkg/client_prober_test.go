@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// 探测结果按配置顺序发布到 expvar, 失败的服务端标记为不健康
+func TestProberExpvar(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startEchoServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().(*net.TCPAddr)
+	_ = l.Close()
+
+	good := testClientConfig(t, addr)
+	servers := []RemoteServer{
+		{Addr: good.RemoteAddr, Port: good.RemotePort},
+		{Addr: closed.IP.String(), Port: closed.Port},
+	}
+	d := NewDialer(&ClientConfig{AuthMethod: socks5.Socks5MethodNoAuth, RemoteServers: servers})
+	defer d.Close()
+
+	p := NewProber(d, &ProberConfig{Target: echo})
+	p.probeAll()
+	// expvar 在进程内全局, 重复运行测试时不能重名
+	name := "test_prober_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	p.PublishExpvar(name)
+
+	var vars []struct {
+		Server      string  `json:"server"`
+		LastProbe   string  `json:"last_probe"`
+		LastError   string  `json:"last_error"`
+		RTTMillis   float64 `json:"rtt_ms"`
+		SuccessRate float64 `json:"success_rate"`
+		Probes      int     `json:"probes"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 2 || vars[0].Server != servers[0].String() || vars[1].Server != servers[1].String() {
+		t.Fatalf("servers: %+v", vars)
+	}
+
+	if ok := vars[0]; ok.LastError != "" || ok.SuccessRate != 1 || ok.Probes != 1 || ok.RTTMillis <= 0 {
+		t.Fatalf("healthy server: %+v", ok)
+	}
+	if _, err := time.Parse(time.RFC3339, vars[0].LastProbe); err != nil {
+		t.Fatalf("last probe: %v", err)
+	}
+	if bad := vars[1]; bad.LastError == "" || bad.SuccessRate != 0 || bad.Probes != 1 {
+		t.Fatalf("unreachable server: %+v", bad)
+	}
+
+	if r := d.remotes.remotes[1]; r.failures == 0 {
+		t.Fatal("unreachable server not marked unhealthy")
+	}
+}
+
+// 成功率只按最近 probeWindow 次探测计算
+func TestProberSuccessWindow(t *testing.T) {
+	d := NewDialer(&ClientConfig{RemoteAddr: "127.0.0.1", RemotePort: 1, AuthMethod: socks5.Socks5MethodNoAuth})
+	defer d.Close()
+	p := NewProber(d, nil)
+	r := d.remotes.remotes[0]
+
+	for i := 0; i < probeWindow; i++ {
+		p.record(r, time.Now(), time.Millisecond, errors.New("down"))
+	}
+	for i := 0; i < probeWindow/2; i++ {
+		p.record(r, time.Now(), time.Millisecond, nil)
+	}
+
+	res := p.Results()[0]
+	if res.Probes != probeWindow || res.Successes != probeWindow/2 || res.SuccessRate() != 0.5 {
+		t.Fatalf("result: %+v", res)
+	}
+	if res.LastError != "" || res.RTT != time.Millisecond {
+		t.Fatalf("last probe: %+v", res)
+	}
+}
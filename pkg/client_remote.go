@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RemoteStrategyRoundRobin = "round-robin"
+	RemoteStrategyLeastConn  = "least-conn"
+	RemoteStrategyLatency    = "latency"
+
+	// 连接或认证失败后暂停使用的时间, 连续失败时翻倍, 不超过 remoteBackoffMax
+	remoteBackoffBase = time.Second
+	remoteBackoffMax  = 2 * time.Minute
+
+	// 握手和认证耗时的平滑系数, 新样本占 1/remoteRTTWeight
+	remoteRTTWeight = 4
+)
+
+// RemoteServer 客户端可以使用的一个服务端
+type RemoteServer struct {
+	Addr string
+	Port int
+}
+
+func (r RemoteServer) String() string {
+	return net.JoinHostPort(r.Addr, strconv.Itoa(r.Port))
+}
+
+// ParseRemoteServers 解析逗号分隔的 host:port
+func ParseRemoteServers(s string) ([]RemoteServer, error) {
+	var servers []RemoteServer
+
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port: %s", addr)
+		}
+		servers = append(servers, RemoteServer{Addr: host, Port: port})
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no remote server in %q", s)
+	}
+	return servers, nil
+}
+
+// servers RemoteServers 为空时使用 RemoteAddr/RemotePort
+func (c *ClientConfig) servers() []RemoteServer {
+	if len(c.RemoteServers) > 0 {
+		return c.RemoteServers
+	}
+	return []RemoteServer{{Addr: c.RemoteAddr, Port: c.RemotePort}}
+}
+
+// remoteState 一个服务端的连接数, 耗时和健康状态
+type remoteState struct {
+	server RemoteServer
+
+	// 以下字段由 remoteBalancer.mu 保护
+	conns     int
+	rtt       time.Duration
+	failures  int
+	downUntil time.Time
+}
+
+// remoteBalancer 按策略在健康的服务端中选择, 都不健康时选择最早恢复的
+type remoteBalancer struct {
+	strategy string
+
+	mu      sync.Mutex
+	remotes []*remoteState
+	next    int
+}
+
+func newRemoteBalancer(config *ClientConfig) *remoteBalancer {
+	b := &remoteBalancer{strategy: config.RemoteStrategy}
+	for _, server := range config.servers() {
+		b.remotes = append(b.remotes, &remoteState{server: server})
+	}
+	return b
+}
+
+// pick 选择一个不在 tried 中的服务端, 都已尝试过时返回 nil
+func (b *remoteBalancer) pick(tried map[*remoteState]bool) *remoteState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var healthy []int
+	earliest := -1
+	// 从轮询位置开始遍历, 条件相同时依次选择
+	for i := range b.remotes {
+		idx := (b.next + i) % len(b.remotes)
+		r := b.remotes[idx]
+		if tried[r] {
+			continue
+		}
+		if !now.Before(r.downUntil) {
+			healthy = append(healthy, idx)
+		} else if earliest < 0 || r.downUntil.Before(b.remotes[earliest].downUntil) {
+			earliest = idx
+		}
+	}
+
+	best := earliest
+	if len(healthy) > 0 {
+		best = healthy[0]
+		for _, idx := range healthy[1:] {
+			r, cur := b.remotes[idx], b.remotes[best]
+			switch b.strategy {
+			case RemoteStrategyLeastConn:
+				if r.conns < cur.conns {
+					best = idx
+				}
+			case RemoteStrategyLatency:
+				// 没有耗时记录的优先, 以便尽快测出耗时
+				if cur.rtt != 0 && (r.rtt == 0 || r.rtt < cur.rtt) {
+					best = idx
+				}
+			}
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	b.next = (best + 1) % len(b.remotes)
+	return b.remotes[best]
+}
+
+// success 握手和认证成功, 恢复健康并记录耗时
+func (b *remoteBalancer) success(r *remoteState, rtt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.failures > 0 {
+		log.Printf("remote server %s recovered\n", r.server)
+	}
+	r.failures = 0
+	r.downUntil = time.Time{}
+
+	if r.rtt == 0 {
+		r.rtt = rtt
+	} else {
+		r.rtt += (rtt - r.rtt) / remoteRTTWeight
+	}
+}
+
+// failure 连接或认证失败, 按连续失败次数指数退避
+func (b *remoteBalancer) failure(r *remoteState, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backoff := remoteBackoffMax
+	if r.failures < 16 {
+		backoff = min(remoteBackoffBase<<r.failures, remoteBackoffMax)
+	}
+	r.failures++
+	r.downUntil = time.Now().Add(backoff)
+
+	log.Printf("remote server %s unhealthy for %v, failures: %d, error: %v\n", r.server, backoff, r.failures, err)
+}
+
+// track 统计到服务端的连接数, 关闭返回的连接时减少
+func (b *remoteBalancer) track(r *remoteState, conn net.Conn) net.Conn {
+	b.mu.Lock()
+	r.conns++
+	b.mu.Unlock()
+
+	return &remoteConn{Conn: conn, release: func() {
+		b.mu.Lock()
+		r.conns--
+		b.mu.Unlock()
+	}}
+}
+
+type remoteConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *remoteConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
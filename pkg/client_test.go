@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+func TestClientNoAuth(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startEchoServer(t)
+
+	conn, err := NewDialer(testClientConfig(t, addr)).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echoRoundTrip(t, conn, "noauth")
+}
+
+// 只设置 AuthMethod 和用户名时同时提供用户名密码认证, 由服务端选择
+func TestClientAuthMethodsFallback(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+	echo := startEchoServer(t)
+
+	config := testClientConfig(t, addr)
+	config.Username, config.Password = "u", "p"
+	conn, err := NewDialer(config).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echoRoundTrip(t, conn, "userpass")
+}
+
+func TestClientNoAcceptableMethod(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+
+	_, err := NewDialer(testClientConfig(t, addr)).Dial("tcp", "127.0.0.1:80")
+	if !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Fatalf("dial: %v, want %v", err, ErrNoAcceptableMethod)
+	}
+}
+
+func TestClientAuthFailed(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+
+	config := testClientConfig(t, addr)
+	config.AuthMethods = []socks5.Socks5Method{socks5.Socks5MethodUserPass}
+	config.Username, config.Password = "u", "wrong"
+	_, err := NewDialer(config).Dial("tcp", "127.0.0.1:80")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("dial: %v, want %v", err, ErrAuthFailed)
+	}
+}
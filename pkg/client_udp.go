@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// socks5NetAddr 目标为域名时的地址
+type socks5NetAddr struct {
+	network string
+	addr    socks5.Socks5Addr
+}
+
+func (a *socks5NetAddr) Network() string {
+	return a.network
+}
+
+func (a *socks5NetAddr) String() string {
+	return socks5HostPort(a.addr)
+}
+
+// socks5NetAddrOf 把 socks5 地址转成 net.Addr, ip 地址返回 *net.TCPAddr 或 *net.UDPAddr
+func socks5NetAddrOf(network string, atyp socks5.Socks5AddrType, addr socks5.Socks5Addr) net.Addr {
+	if atyp == socks5.Socks5AddrTypeDomainName {
+		return &socks5NetAddr{network: network, addr: addr}
+	}
+
+	ip := net.ParseIP(addr.Addr)
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: int(addr.Port)}
+	}
+	return &net.TCPAddr{IP: ip, Port: int(addr.Port)}
+}
+
+// udpPacketConn 通过 socks5 udp 中继收发报文, 发送时加上报文头, 接收时去掉报文头;
+// 控制连接断开时关联结束, 之后的读写返回错误
+type udpPacketConn struct {
+	conn     *net.UDPConn
+	ctrlConn net.Conn
+	relay    *net.UDPAddr
+
+	readMu  sync.Mutex
+	readBuf []byte
+
+	closeOnce sync.Once
+}
+
+func newUdpPacketConn(conn *net.UDPConn, ctrlConn net.Conn, relay *net.UDPAddr) *udpPacketConn {
+	c := &udpPacketConn{
+		conn:     conn,
+		ctrlConn: ctrlConn,
+		relay:    relay,
+		readBuf:  make([]byte, udpBufferSize),
+	}
+
+	go func() {
+		// 控制连接上不会再有数据, 读到 EOF 说明关联已结束
+		_, _ = io.Copy(io.Discard, ctrlConn)
+		_ = c.Close()
+	}()
+
+	return c
+}
+
+func (c *udpPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		n, from, err := c.conn.ReadFromUDP(c.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// 只接受中继发来的报文, 不支持分片
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+
+		msg, err := unpackUdpPackage(c.readBuf[:n])
+		if err != nil || msg.Frag != 0 {
+			continue
+		}
+
+		return copy(p, msg.Data), socks5NetAddrOf("udp", msg.Atyp, msg.Addr), nil
+	}
+}
+
+func (c *udpPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var atyp socks5.Socks5AddrType
+	var dst socks5.Socks5Addr
+
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		atyp, dst = socks5AddrOf(udpAddr)
+	} else {
+		host, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return 0, err
+		}
+		atyp, dst = socks5AddrTypeOf(host), socks5.Socks5Addr{Addr: host, Port: uint16(port)}
+	}
+
+	packet, err := packUdpPackage(&socks5.Socks5UdpPackage{
+		Atyp: atyp,
+		Addr: dst,
+		Data: p,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.conn.WriteToUDP(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *udpPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		_ = c.ctrlConn.Close()
+	})
+	return err
+}
+
+func (c *udpPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *udpPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *udpPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *udpPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialStore 校验用户名密码, 用于 socks5 用户名密码认证
+type CredentialStore interface {
+	Verify(username, password string) (bool, error)
+}
+
+// staticCredentials 只有一个用户, 对应 ServerConfig.User/Password
+type staticCredentials struct {
+	user     string
+	password string
+}
+
+func (c *staticCredentials) Verify(username, password string) (bool, error) {
+	userOk := subtle.ConstantTimeCompare([]byte(c.user), []byte(username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) == 1
+	return userOk && passOk, nil
+}
+
+// 用户不存在时也做一次 bcrypt 比较, 避免通过耗时判断用户是否存在; 第一次用到时才生成, 不拖慢启动
+var (
+	dummyBcryptHash     []byte
+	dummyBcryptHashOnce sync.Once
+)
+
+func dummyHash() []byte {
+	dummyBcryptHashOnce.Do(func() {
+		dummyBcryptHash, _ = bcrypt.GenerateFromPassword([]byte("socks-fly"), bcrypt.DefaultCost)
+	})
+	return dummyBcryptHash
+}
+
+// fileCredentials 从 htpasswd 风格的文件加载用户, 每行 "username:hash",
+// hash 支持 bcrypt ($2a$/$2b$/$2y$) 和 argon2id ($argon2id$v=19$m=65536,t=3,p=4$salt$key)
+type fileCredentials struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+func NewFileCredentialStore(path string) (*fileCredentials, error) {
+	c := &fileCredentials{path: path}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload 重新读取用户文件
+func (c *fileCredentials) Reload() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return fmt.Errorf("%s:%d: invalid line", c.path, lineNo)
+		}
+		if !isBcryptHash(hash) && !strings.HasPrefix(hash, "$argon2id$") {
+			return fmt.Errorf("%s:%d: unsupported hash for user %s", c.path, lineNo, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.users = users
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fileCredentials) Verify(username, password string) (bool, error) {
+	c.mu.RLock()
+	hash, ok := c.users[username]
+	c.mu.RUnlock()
+
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false, nil
+	}
+
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	return verifyArgon2id(hash, password)
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// verifyArgon2id 校验 PHC 格式的 argon2id hash
+func verifyArgon2id(hash, password string) (bool, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2id version")
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.New("invalid argon2id params")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const defaultExternalAuthTimeout = 5 * time.Second
+
+// httpCredentials 把用户名密码 POST 到认证服务:
+// 请求 {"username": "...", "password": "..."}, 返回 200 {"allow": true|false},
+// 401/403 视为认证失败, 其他状态码视为认证服务出错
+type httpCredentials struct {
+	url    string
+	client *http.Client
+}
+
+type httpAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type httpAuthResponse struct {
+	Allow bool `json:"allow"`
+}
+
+func NewHttpCredentialStore(url string, timeout time.Duration) *httpCredentials {
+	if timeout <= 0 {
+		timeout = defaultExternalAuthTimeout
+	}
+
+	return &httpCredentials{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *httpCredentials) Verify(username, password string) (bool, error) {
+	body, err := json.Marshal(&httpAuthRequest{Username: username, Password: password})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("auth service status: %s", resp.Status)
+	}
+
+	authResp := &httpAuthResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(authResp); err != nil {
+		return false, err
+	}
+
+	return authResp.Allow, nil
+}
+
+// execCredentials 执行本地命令认证, 用户名和密码各占一行写入 stdin,
+// 退出码 0 表示通过, 1 表示认证失败, 其他视为命令出错
+type execCredentials struct {
+	name    string
+	args    []string
+	timeout time.Duration
+}
+
+func NewExecCredentialStore(name string, args []string, timeout time.Duration) *execCredentials {
+	if timeout <= 0 {
+		timeout = defaultExternalAuthTimeout
+	}
+
+	return &execCredentials{
+		name:    name,
+		args:    args,
+		timeout: timeout,
+	}
+}
+
+func (c *execCredentials) Verify(username, password string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.name, c.args...)
+	cmd.Stdin = bytes.NewBufferString(username + "\n" + password + "\n")
+
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// cachedCredentials 缓存认证结果, 避免每个连接都请求外部认证, 出错的结果不缓存
+type cachedCredentials struct {
+	store CredentialStore
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedCredential
+}
+
+type cachedCredential struct {
+	ok       bool
+	expireAt time.Time
+}
+
+// 缓存条目超过该数量时清理过期条目
+const credentialCacheSweepSize = 4096
+
+// 缓存 key 的 HMAC 密钥, 每个进程随机生成, 内存中的 key 无法离线穷举密码
+var credentialCacheKey = newCredentialCacheKey()
+
+func newCredentialCacheKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("generate credential cache key: %v", err))
+	}
+	return key
+}
+
+func NewCachedCredentialStore(store CredentialStore, ttl time.Duration) *cachedCredentials {
+	return &cachedCredentials{
+		store:   store,
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]cachedCredential),
+	}
+}
+
+func (c *cachedCredentials) Verify(username, password string) (bool, error) {
+	key := credentialCacheEntryKey(username, password)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expireAt) {
+		return entry.ok, nil
+	}
+
+	allow, err := c.store.Verify(username, password)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= credentialCacheSweepSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expireAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= credentialCacheSweepSize {
+			c.entries = make(map[[sha256.Size]byte]cachedCredential)
+		}
+	}
+	c.entries[key] = cachedCredential{ok: allow, expireAt: now.Add(c.ttl)}
+	c.mu.Unlock()
+
+	return allow, nil
+}
+
+// credentialCacheEntryKey 用户名长度前缀避免 "a"+"bc" 与 "ab"+"c" 冲突, 缓存中不保存明文密码
+func credentialCacheEntryKey(username, password string) [sha256.Size]byte {
+	var key [sha256.Size]byte
+
+	mac := hmac.New(sha256.New, credentialCacheKey)
+	_, _ = fmt.Fprintf(mac, "%d:%s%s", len(username), username, password)
+	copy(key[:], mac.Sum(nil))
+	return key
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestHttpCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		delay   time.Duration
+		ok      bool
+		wantErr bool
+	}{
+		{name: "allow", status: http.StatusOK, body: `{"allow": true}`, ok: true},
+		{name: "deny", status: http.StatusOK, body: `{"allow": false}`},
+		{name: "unauthorized", status: http.StatusUnauthorized},
+		{name: "forbidden", status: http.StatusForbidden},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+		{name: "bad gateway", status: http.StatusBadGateway, wantErr: true},
+		{name: "malformed json", status: http.StatusOK, body: `{"allow": tru`, wantErr: true},
+		{name: "timeout", status: http.StatusOK, body: `{"allow": true}`, delay: time.Second, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req httpAuthRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username != "user" || req.Password != "pass" {
+					t.Errorf("auth request: %+v, %v", req, err)
+				}
+
+				select {
+				case <-time.After(tt.delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			ok, err := NewHttpCredentialStore(srv.URL, 100*time.Millisecond).Verify("user", "pass")
+			if ok != tt.ok || (err != nil) != tt.wantErr {
+				t.Fatalf("verify: %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestExecCredentials(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	// 第一行为用户名, 第二行为密码
+	script := `read user; read pass; [ "$user" = user ] || exit 2; [ "$pass" = pass ] && exit 0; [ "$pass" = fail ] && exit 3; exit 1`
+	store := NewExecCredentialStore("sh", []string{"-c", script}, time.Second)
+
+	tests := []struct {
+		password string
+		ok       bool
+		wantErr  bool
+	}{
+		{password: "pass", ok: true},
+		{password: "wrong"},
+		{password: "fail", wantErr: true},
+	}
+	for _, tt := range tests {
+		ok, err := store.Verify("user", tt.password)
+		if ok != tt.ok || (err != nil) != tt.wantErr {
+			t.Fatalf("verify %s: %v, %v", tt.password, ok, err)
+		}
+	}
+
+	if _, err := NewExecCredentialStore("sh", []string{"-c", "sleep 5"}, 100*time.Millisecond).Verify("user", "pass"); err == nil {
+		t.Fatal("verify did not time out")
+	}
+}
+
+// stubCredentials 按顺序返回结果, 统计调用次数
+type stubCredentials struct {
+	results []stubResult
+	calls   int
+}
+
+type stubResult struct {
+	ok  bool
+	err error
+}
+
+func (s *stubCredentials) Verify(username, password string) (bool, error) {
+	r := s.results[s.calls]
+	s.calls++
+	return r.ok, r.err
+}
+
+func TestCachedCredentialsTTL(t *testing.T) {
+	stub := &stubCredentials{results: []stubResult{{ok: true}, {ok: false}}}
+	store := NewCachedCredentialStore(stub, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if ok, err := store.Verify("user", "pass"); !ok || err != nil {
+			t.Fatalf("verify: %v, %v", ok, err)
+		}
+	}
+	if stub.calls != 1 {
+		t.Fatalf("store called %d times before expiry", stub.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, err := store.Verify("user", "pass"); ok || err != nil {
+		t.Fatalf("verify after expiry: %v, %v", ok, err)
+	}
+	if stub.calls != 2 {
+		t.Fatalf("store called %d times after expiry", stub.calls)
+	}
+}
+
+func TestCachedCredentialsErrorNotCached(t *testing.T) {
+	stub := &stubCredentials{results: []stubResult{{err: errors.New("unavailable")}, {ok: true}}}
+	store := NewCachedCredentialStore(stub, time.Minute)
+
+	if _, err := store.Verify("user", "pass"); err == nil {
+		t.Fatal("error not returned")
+	}
+	if ok, err := store.Verify("user", "pass"); !ok || err != nil {
+		t.Fatalf("verify after error: %v, %v", ok, err)
+	}
+	if stub.calls != 2 {
+		t.Fatalf("store called %d times", stub.calls)
+	}
+}
+
+// 不同的用户名密码分别缓存
+func TestCachedCredentialsKey(t *testing.T) {
+	stub := &stubCredentials{results: []stubResult{{ok: true}, {ok: false}}}
+	store := NewCachedCredentialStore(stub, time.Minute)
+
+	if ok, _ := store.Verify("a", "bc"); !ok {
+		t.Fatal("a/bc denied")
+	}
+	if ok, _ := store.Verify("ab", "c"); ok {
+		t.Fatal("ab/c used the cached result of a/bc")
+	}
+}
+
+// 缓存 key 使用进程内的随机密钥, 与不加盐的 sha256 不同, 换了密钥后也不同
+func TestCachedCredentialsKeyHmac(t *testing.T) {
+	key := credentialCacheEntryKey("alice", "secret")
+	if key != credentialCacheEntryKey("alice", "secret") {
+		t.Fatal("cache key is not stable")
+	}
+	if key == sha256.Sum256([]byte(fmt.Sprintf("%d:%s%s", len("alice"), "alice", "secret"))) {
+		t.Fatal("cache key is an unkeyed sha256")
+	}
+
+	saved := credentialCacheKey
+	defer func() {
+		credentialCacheKey = saved
+	}()
+	credentialCacheKey = newCredentialCacheKey()
+	if key == credentialCacheEntryKey("alice", "secret") {
+		t.Fatal("cache key does not depend on the process key")
+	}
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestFileCredentials(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("bob-pass"), salt, 1, 1024, 1, 32)
+	argonHash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	path := filepath.Join(t.TempDir(), "users")
+	data := "# users\n\nalice:" + string(bcryptHash) + "\nbob:" + argonHash + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 加载用户时不生成, 第一次校验不存在的用户时才生成
+	dummyBcryptHash, dummyBcryptHashOnce = nil, sync.Once{}
+	store, err := NewFileCredentialStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dummyBcryptHash != nil {
+		t.Fatal("dummy hash generated before first use")
+	}
+
+	for _, tt := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "alice-pass", true},
+		{"alice", "wrong", false},
+		{"bob", "bob-pass", true},
+		{"bob", "wrong", false},
+		{"carol", "alice-pass", false},
+	} {
+		ok, err := store.Verify(tt.user, tt.password)
+		if ok != tt.ok || err != nil {
+			t.Fatalf("verify %s/%s: %v, %v", tt.user, tt.password, ok, err)
+		}
+	}
+
+	if _, err := bcrypt.Cost(dummyBcryptHash); err != nil {
+		t.Fatalf("dummy hash: %v", err)
+	}
+}
+
+func TestFileCredentialsInvalid(t *testing.T) {
+	for _, data := range []string{"alice\n", "alice:\n", "alice:plaintext\n"} {
+		path := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFileCredentialStore(path); err == nil {
+			t.Fatalf("loaded %q", data)
+		}
+	}
+}
+
+// 服务端使用用户文件校验客户端的用户名密码
+func TestServerFileCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileCredentialStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, Credentials: store})
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{
+		{"alice-pass", true},
+		{"wrong", false},
+	} {
+		c := NewClient(&ClientConfig{RemoteAddr: host, RemotePort: p, Username: "alice", Password: tt.password})
+		err := c.Open()
+		if (err == nil) != tt.ok {
+			t.Fatalf("open with %s: %v", tt.password, err)
+		}
+		if err == nil {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// Dialer 通过 socks5 服务端建立 tcp 连接, 返回的连接已完成握手, 认证和 CONNECT,
+// 实现了 golang.org/x/net/proxy 的 Dialer/ContextDialer, 也可作为 http.Transport.DialContext 使用
+type Dialer struct {
+	config *ClientConfig
+	// 可用的服务端, 见 ClientConfig.RemoteServers
+	remotes *remoteBalancer
+	// config.MuxSessions 大于 0 时 CONNECT 通过多路复用会话上的流建立
+	mux *muxPool
+	// config.PoolSize 大于 0 且未开启多路复用时, CONNECT 优先使用已认证的空闲连接
+	pool *connPool
+	// 用户名密码来自最终用户 (见 withCredentials), 认证失败不是服务端的问题, 不标记不健康也不换服务端重试
+	userCredentials bool
+}
+
+func NewDialer(config *ClientConfig) *Dialer {
+	d := &Dialer{config: config, remotes: newRemoteBalancer(config)}
+	if config.MuxSessions > 0 {
+		d.mux = newMuxPool(d, config.MuxSessions)
+	} else if config.PoolSize > 0 {
+		d.pool = newConnPool(d, config)
+	}
+	return d
+}
+
+// withCredentials 返回使用指定用户名密码认证的 Dialer, 与 d 共享服务端的健康状态和连接数;
+// 多路复用会话和空闲连接按 d 的用户认证, 返回的 Dialer 每个连接单独认证
+func (d *Dialer) withCredentials(username, password string) *Dialer {
+	config := *d.config
+	config.Username = username
+	config.Password = password
+	config.MuxSessions = 0
+	config.PoolSize = 0
+
+	return &Dialer{config: &config, remotes: d.remotes, userCredentials: true}
+}
+
+// Close 关闭多路复用会话和空闲连接, 会话上的连接随之断开; 已返回的普通连接不受影响
+func (d *Dialer) Close() error {
+	if d.mux != nil {
+		d.mux.close()
+	}
+	if d.pool != nil {
+		d.pool.close()
+	}
+	return nil
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network not support: %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多路复用会话或空闲连接不可用时按普通方式重新连接, 以便换一个服务端重试;
+	// 服务端已应答 CONNECT 失败 (如目标拒绝连接) 时直接返回
+	if d.mux != nil {
+		conn, err := d.dialStream(ctx, host, port)
+		if err == nil || ctx.Err() != nil || isConnectReplyErr(err) {
+			return conn, err
+		}
+		log.Printf("mux stream to %s error: %v, dial directly\n", addr, err)
+	} else if d.pool != nil {
+		if conn := d.pool.get(); conn != nil {
+			conn, err := d.connect(ctx, conn, host, port)
+			if err == nil || ctx.Err() != nil || isConnectReplyErr(err) {
+				return conn, err
+			}
+			log.Printf("pooled conn to %s error: %v, dial directly\n", addr, err)
+		}
+	}
+
+	return d.dial(ctx, func(cli *client) error {
+		return cli.connectHost(host, port)
+	})
+}
+
+// dialStream 在多路复用会话上新建流并发送 CONNECT, 流上不再握手和认证
+func (d *Dialer) dialStream(ctx context.Context, host string, port int) (net.Conn, error) {
+	stream, err := d.mux.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.connect(ctx, stream, host, port)
+}
+
+// connect 在已认证的 conn 上发送 CONNECT, 失败时关闭 conn
+func (d *Dialer) connect(ctx context.Context, conn net.Conn, host string, port int) (net.Conn, error) {
+	stop := watchContext(ctx, conn)
+
+	cli := NewClient(d.config)
+	cli.conn = conn
+	err := cli.connectHost(host, port)
+
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// ListenPacket 通过 UDP ASSOCIATE 建立 udp 关联, 返回的 PacketConn 收发时自动处理 socks5 udp 报文头,
+// 关闭 PacketConn 时断开控制连接, 控制连接断开时 PacketConn 也随之关闭
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var relay *net.UDPAddr
+	ctrlConn, err := d.dial(ctx, func(cli *client) error {
+		var err error
+		relay, err = cli.udpAssociate()
+		return err
+	})
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+
+	return newUdpPacketConn(udpConn, ctrlConn, relay), nil
+}
+
+// Listen 通过 BIND 在服务端监听, peer 为期望连入的对端地址 "host:port", 为空时不限制;
+// 返回的 Listener 的 Addr 为服务端的监听地址, 只能 Accept 一个连接, 适用于主动模式 FTP 等反向连接
+func (d *Dialer) Listen(ctx context.Context, peer string) (net.Listener, error) {
+	host, port := net.IPv4zero.String(), 0
+	if peer != "" {
+		h, portStr, err := net.SplitHostPort(peer)
+		if err != nil {
+			return nil, err
+		}
+		if port, err = net.LookupPort("tcp", portStr); err != nil {
+			return nil, err
+		}
+		host = h
+	}
+
+	l := &bindListener{}
+	_, err := d.dial(ctx, func(cli *client) error {
+		resp, err := cli.bind(socks5AddrTypeOf(host), host, port)
+		if err != nil {
+			return err
+		}
+
+		addr := socks5NetAddrOf("tcp", resp.Atyp, resp.Addr)
+		// 服务端监听在全零地址时使用控制连接的地址
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok && (tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified()) {
+			if serverAddr, ok := cli.conn.RemoteAddr().(*net.TCPAddr); ok {
+				tcpAddr.IP = serverAddr.IP
+			}
+		}
+
+		l.cli = cli
+		l.addr = addr
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// dial 按策略选择服务端, 连接并完成握手和认证, 再执行 fn 发送命令 (fn 为空时不发送), 整个过程受 ctx 控制;
+// 连接, tls 或认证失败时换一个没有尝试过的服务端重试, 返回的连接上还没有发送过数据
+func (d *Dialer) dial(ctx context.Context, fn func(cli *client) error) (net.Conn, error) {
+	tried := make(map[*remoteState]bool)
+	var err error
+	for {
+		r := d.remotes.pick(tried)
+		if r == nil {
+			return nil, err
+		}
+		tried[r] = true
+
+		var conn net.Conn
+		if conn, err = d.dialRemote(ctx, r, fn); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || d.isUserAuthErr(err) || isConnectReplyErr(err) {
+			return nil, err
+		}
+		if len(tried) < len(d.remotes.remotes) {
+			log.Printf("remote server %s error: %v, retry another\n", r.server, err)
+		}
+	}
+}
+
+// dialRemote 通过服务端 r 建立连接, 连接, tls 或认证失败时标记服务端不健康
+func (d *Dialer) dialRemote(ctx context.Context, r *remoteState, fn func(cli *client) error) (net.Conn, error) {
+	start := time.Now()
+
+	var netDialer net.Dialer
+	rawConn, err := netDialer.DialContext(ctx, "tcp", r.server.String())
+	if err != nil {
+		if ctx.Err() == nil {
+			d.remotes.failure(r, err)
+		}
+		return nil, err
+	}
+	tracked := d.remotes.track(r, rawConn)
+
+	// 截止时间设置在底层连接上, 对 tls 连接同样生效
+	stop := watchContext(ctx, rawConn)
+
+	config := *d.config
+	config.RemoteAddr = r.server.Addr
+	config.RemotePort = r.server.Port
+
+	cli := NewClient(&config)
+	conn, err := cli.wrapTLS(ctx, tracked)
+	if err == nil {
+		err = cli.openConn(conn)
+	}
+	authErr := err
+	if err == nil && fn != nil {
+		err = fn(cli)
+	}
+
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	} else if authErr != nil {
+		if !d.isUserAuthErr(authErr) {
+			d.remotes.failure(r, authErr)
+		}
+	} else {
+		d.remotes.success(r, time.Since(start))
+	}
+	if err != nil {
+		_ = tracked.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) isUserAuthErr(err error) bool {
+	return d.userCredentials && errors.Is(err, ErrAuthFailed)
+}
+
+// isConnectReplyErr 服务端应答 CONNECT 失败, 失败原因在目标而不在服务端, 换服务端或重新连接也不会成功;
+// 服务端不支持多路复用等其他命令的应答失败不算
+func isConnectReplyErr(err error) bool {
+	var replyErr *ReplyError
+	return errors.As(err, &replyErr) && replyErr.Cmd == socks5.Socks5CmdConnect
+}
+
+// watchContext 在 ctx 结束时中断 conn 上阻塞的读写, 有截止时间时同时设置到 conn 上;
+// 返回的 stop 停止监听并清除截止时间, ctx 已结束时返回 ctx.Err()
+func watchContext(ctx context.Context, conn net.Conn) (stop func() error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	doneCh := make(chan struct{})
+	exitCh := make(chan struct{})
+	go func() {
+		defer close(exitCh)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+		case <-doneCh:
+		}
+	}()
+
+	return func() error {
+		close(doneCh)
+		<-exitCh
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// conn 的截止时间可能先于 ctx 的定时器触发
+		if hasDeadline && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return nil
+	}
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// dialerConfig 返回连接 addr 的客户端配置, 用户名密码为 u/p
+func dialerConfig(t *testing.T, addr string) *ClientConfig {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &ClientConfig{RemoteAddr: host, RemotePort: p, Username: "u", Password: "p"}
+}
+
+func TestDialerDial(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+	echo := startEchoServer(t)
+
+	conn, err := NewDialer(dialerConfig(t, addr)).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echoRoundTrip(t, conn, "dialer")
+}
+
+func TestDialerNetworkNotSupported(t *testing.T) {
+	if _, err := NewDialer(&ClientConfig{}).Dial("udp", "127.0.0.1:53"); err == nil {
+		t.Fatal("dial udp succeeded")
+	}
+}
+
+// 服务端不应答握手时, ctx 取消或超时后 DialContext 立即返回 ctx 的错误
+func TestDialerDialContextCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := NewDialer(dialerConfig(t, l.Addr().String()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:80"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled dial: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("canceled dial took %s", elapsed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("timed out dial: %v", err)
+	}
+}
+
+func TestDialerListenPacket(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+	echo := startUdpEchoServer(t, net.IPv4(127, 0, 0, 1))
+
+	conn, err := NewDialer(dialerConfig(t, addr)).ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.WriteTo([]byte("packet"), echo); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, udpBufferSize)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "packet" || from.String() != echo.String() {
+		t.Fatalf("reply %q from %s, want %q from %s", buf[:n], from, "packet", echo)
+	}
+
+	// 关闭后不能再收发
+	_ = conn.Close()
+	if _, err := conn.WriteTo([]byte("packet"), echo); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+}
+
+func TestDialerListen(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+
+	l, err := NewDialer(dialerConfig(t, addr)).Listen(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Fatalf("remote addr: %s, want %s", conn.RemoteAddr(), peer.LocalAddr())
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("bind data: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// startTestServer 在空闲端口上启动服务端, 等到可以连接后返回地址; config.Addr 为空时监听 127.0.0.1
+func startTestServer(t *testing.T, config *ServerConfig) string {
+	t.Helper()
+	return startTestServerWith(t, config, NewServer)
+}
+
+// startTestServerWith 同 startTestServer, 用 newServer 创建服务端
+func startTestServerWith(t *testing.T, config *ServerConfig, newServer func(*ServerConfig) *server) string {
+	t.Helper()
+
+	if config.Addr == "" {
+		config.Addr = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(config.Addr, "0"))
+	if err != nil {
+		t.Skipf("listen on %s: %v", config.Addr, err)
+	}
+	config.Port = l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	s := newServer(config)
+	go func() {
+		_ = s.Serve()
+	}()
+
+	addr := net.JoinHostPort(config.Addr, strconv.Itoa(config.Port))
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			t.Cleanup(func() {
+				_ = s.Stop()
+			})
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server not listening on %s", addr)
+	return ""
+}
+
+// startEchoServer 回显收到的数据
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	return startEchoServerOn(t, "127.0.0.1:0")
+}
+
+// startEchoServerOn 在 addr 上启动回显服务, 无法监听时跳过测试
+func startEchoServerOn(t *testing.T, addr string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startUdpEchoServer 回显收到的 udp 报文
+func startUdpEchoServer(t *testing.T, ip net.IP) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("listen udp on %s: %v", ip, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// dialSocks5 连接服务端并按 methods 握手, 返回连接和服务端选择的认证方式
+func dialSocks5(t *testing.T, addr string, methods ...socks5.Socks5Method) (net.Conn, socks5.Socks5Method) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if len(methods) == 0 {
+		methods = []socks5.Socks5Method{socks5.Socks5MethodNoAuth}
+	}
+	req := &socks5.HandshakeReq{Ver: socks5.Socks5Version5, NMethods: uint8(len(methods)), Methods: methods}
+	if _, err := conn.Write(req.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return conn, socks5.Socks5Method(resp[1])
+}
+
+// socks5Request 发送命令并读取应答, addr 为 "host:port"
+func socks5Request(t *testing.T, conn net.Conn, cmd socks5.Socks5Cmd, addr string) *socks5.Socks5CmdResponse {
+	t.Helper()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	atyp := socks5.Socks5AddrTypeDomainName
+	if ip := net.ParseIP(host); ip != nil {
+		atyp = socks5.Socks5AddrTypeIPv6
+		if ip.To4() != nil {
+			atyp = socks5.Socks5AddrTypeIPv4
+		}
+	}
+	req, err := appendSocks5Addr([]byte{byte(socks5.Socks5Version5), byte(cmd), 0, byte(atyp)},
+		atyp, socks5.Socks5Addr{Addr: host, Port: uint16(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	return readSocks5Reply(t, conn)
+}
+
+// readSocks5Reply 读取一个命令应答
+func readSocks5Reply(t *testing.T, conn net.Conn) *socks5.Socks5CmdResponse {
+	t.Helper()
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal(err)
+	}
+	resp := &socks5.Socks5CmdResponse{
+		Ver:  socks5.Socks5Version(head[0]),
+		Rep:  socks5.Socks5Rep(head[1]),
+		Atyp: socks5.Socks5AddrType(head[3]),
+	}
+	var err error
+	if resp.Addr, err = readSocks5Addr(conn, resp.Atyp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// testClientConfig 返回连接 addr 的不认证客户端配置
+func testClientConfig(t *testing.T, addr string) *ClientConfig {
+	t.Helper()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	return &ClientConfig{RemoteAddr: host, RemotePort: port, AuthMethod: socks5.Socks5MethodNoAuth}
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// PACConfig 生成 proxy.pac/wpad.dat 的规则, 域名规则匹配域名本身及其子域名,
+// 先匹配直连的域名, 再匹配走代理的域名, 都不匹配时按 ProxyByDefault; 不带点的主机名总是直连
+type PACConfig struct {
+	DirectDomains  []string
+	ProxyDomains   []string
+	ProxyByDefault bool
+	// PAC 中的代理地址 host:port, 为空时使用浏览器获取 PAC 时访问的地址
+	ProxyAddr string
+}
+
+// isPACRequest 浏览器直接请求 /proxy.pac 或 /wpad.dat, 不是代理请求
+func isPACRequest(req *http.Request) bool {
+	if req.URL.Host != "" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return false
+	}
+	return req.URL.Path == "/proxy.pac" || req.URL.Path == "/wpad.dat"
+}
+
+// generate 生成 PAC 脚本, proxyAddr 为代理的 host:port
+func (c *PACConfig) generate(proxyAddr string) ([]byte, error) {
+	direct, err := json.Marshal(trimDomains(c.DirectDomains))
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := json.Marshal(trimDomains(c.ProxyDomains))
+	if err != nil {
+		return nil, err
+	}
+	proxyStr, err := json.Marshal("PROXY " + proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultStr := `"DIRECT"`
+	if c.ProxyByDefault {
+		defaultStr = "proxy"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "var direct = %s;\n", direct)
+	fmt.Fprintf(&b, "var proxied = %s;\n", proxy)
+	fmt.Fprintf(&b, "var proxy = %s;\n\n", proxyStr)
+	b.WriteString("function matchDomain(host, domains) {\n")
+	b.WriteString("  for (var i = 0; i < domains.length; i++) {\n")
+	b.WriteString("    if (host === domains[i] || dnsDomainIs(host, \".\" + domains[i])) {\n")
+	b.WriteString("      return true;\n")
+	b.WriteString("    }\n")
+	b.WriteString("  }\n")
+	b.WriteString("  return false;\n")
+	b.WriteString("}\n\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	b.WriteString("  if (isPlainHostName(host) || matchDomain(host, direct)) {\n")
+	b.WriteString("    return \"DIRECT\";\n")
+	b.WriteString("  }\n")
+	b.WriteString("  if (matchDomain(host, proxied)) {\n")
+	b.WriteString("    return proxy;\n")
+	b.WriteString("  }\n")
+	fmt.Fprintf(&b, "  return %s;\n", defaultStr)
+	b.WriteString("}\n")
+
+	return b.Bytes(), nil
+}
+
+// trimDomains 统一为小写, 去掉空白和开头的点
+func trimDomains(domains []string) []string {
+	trimmed := make([]string, 0, len(domains))
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d != "" {
+			trimmed = append(trimmed, d)
+		}
+	}
+	return trimmed
+}
+
+// servePAC 返回 PAC 脚本, 返回客户端连接是否可以继续读取下一个请求
+func (p *httpProxy) servePAC(conn net.Conn, req *http.Request) bool {
+	proxyAddr := p.config.PAC.ProxyAddr
+	if proxyAddr == "" {
+		// 通过 DNS 的 WPAD 获取时 Host 可能不带端口, 这时使用本地监听地址
+		if _, _, err := net.SplitHostPort(req.Host); err == nil {
+			proxyAddr = req.Host
+		} else {
+			proxyAddr = conn.LocalAddr().String()
+		}
+	}
+
+	script, err := p.config.PAC.generate(proxyAddr)
+	if err != nil {
+		_ = p.writeHttpError(conn, http.StatusInternalServerError)
+		return false
+	}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(script)),
+		Body:          io.NopCloser(bytes.NewReader(script)),
+		Close:         req.Close,
+		// HEAD 请求只返回响应头
+		Request: req,
+	}
+	resp.Header.Set("Content-Type", pacContentType)
+	resp.Header.Set("Cache-Control", "no-cache")
+
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	return !req.Close
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pacVar 取出 PAC 脚本中 "var name = <json>;" 的值
+func pacVar(t *testing.T, script, name string, v interface{}) {
+	t.Helper()
+
+	prefix := "var " + name + " = "
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(line, prefix) && strings.HasSuffix(line, ";") {
+			if err := json.Unmarshal([]byte(strings.TrimSuffix(strings.TrimPrefix(line, prefix), ";")), v); err != nil {
+				t.Fatalf("var %s: %v", name, err)
+			}
+			return
+		}
+	}
+	t.Fatalf("var %s not found in:\n%s", name, script)
+}
+
+// 域名和代理地址作为 JS 字符串字面量输出, 不能跳出字符串
+func TestPACGenerateEscaping(t *testing.T) {
+	c := &PACConfig{
+		DirectDomains: []string{" .Example.COM ", `evil"];alert(1);//`, "", "line\u2028sep"},
+		ProxyDomains:  []string{`back\slash`, "</script>"},
+	}
+	script, err := c.generate(`proxy"host:3128`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(script)
+
+	var direct, proxied []string
+	var proxy string
+	pacVar(t, s, "direct", &direct)
+	pacVar(t, s, "proxied", &proxied)
+	pacVar(t, s, "proxy", &proxy)
+
+	if want := []string{"example.com", `evil"];alert(1);//`, "line\u2028sep"}; !reflect.DeepEqual(direct, want) {
+		t.Errorf("direct: %q, want %q", direct, want)
+	}
+	if want := []string{`back\slash`, "</script>"}; !reflect.DeepEqual(proxied, want) {
+		t.Errorf("proxied: %q, want %q", proxied, want)
+	}
+	if proxy != `PROXY proxy"host:3128` {
+		t.Errorf("proxy: %q", proxy)
+	}
+	for _, raw := range []string{"\u2028", "</script>", `evil"]`, `proxy"host`} {
+		if strings.Contains(s, raw) {
+			t.Errorf("unescaped %q in script", raw)
+		}
+	}
+
+	if !strings.Contains(s, "return \"DIRECT\";\n}") {
+		t.Errorf("default not direct:\n%s", s)
+	}
+	c.ProxyByDefault = true
+	if script, _ = c.generate("127.0.0.1:8080"); !strings.Contains(string(script), "return proxy;\n}") {
+		t.Errorf("default not proxy:\n%s", script)
+	}
+}
+
+// PAC 不需要认证, 代理地址默认取请求的 Host, Host 不带端口时取本地监听地址
+func TestHttpProxyPAC(t *testing.T) {
+	addr := startHttpProxy(t, &HttpProxyConfig{
+		Credentials: &staticCredentials{user: "alice", password: "secret"},
+		PAC:         &PACConfig{ProxyDomains: []string{"example.com"}},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	for _, tt := range []struct {
+		method, path, host string
+		proxy              string
+	}{
+		{http.MethodGet, "/proxy.pac", "proxy.lan:3128", "PROXY proxy.lan:3128"},
+		{http.MethodGet, "/wpad.dat", "wpad", "PROXY " + addr},
+		{http.MethodHead, "/wpad.dat", "wpad", ""},
+	} {
+		if _, err := fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", tt.method, tt.path, tt.host); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, &http.Request{Method: tt.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != pacContentType {
+			t.Fatalf("%s %s: %d %s", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if tt.method == http.MethodHead {
+			if len(body) != 0 || resp.ContentLength <= 0 {
+				t.Fatalf("HEAD body %d bytes, content length %d", len(body), resp.ContentLength)
+			}
+			continue
+		}
+
+		var proxy string
+		pacVar(t, string(body), "proxy", &proxy)
+		if proxy != tt.proxy {
+			t.Fatalf("%s host %s: proxy %q, want %q", tt.path, tt.host, proxy, tt.proxy)
+		}
+	}
+
+	// 其他路径仍然是代理请求, 需要认证
+	if resp := proxyRoundTrip(t, addr, "GET http://example.com/proxy.pac HTTP/1.1\r\nHost: example.com\r\n\r\n"); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("proxied pac path: %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+}
@@ -1,39 +1,108 @@
 package pkg
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/url"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
+var errHttpAuthFailed = errors.New("proxy authentication required")
+
+// HttpProxyConfig http 代理的选项
+type HttpProxyConfig struct {
+	// 添加 Via 请求头
+	Via bool
+	// 把客户端 ip 追加到 X-Forwarded-For 请求头
+	XForwardedFor bool
+
+	// 本地用户, 不为空时要求客户端通过 Proxy-Authorization 进行 Basic 认证
+	Credentials CredentialStore
+	// 把客户端 Basic 认证的用户名密码作为 socks5 服务端的用户名密码,
+	// 未设置 Credentials 时由 socks5 服务端校验用户名密码
+	PassThroughAuth bool
+
+	// 不为空时在 /proxy.pac 和 /wpad.dat 提供 PAC 脚本, 获取 PAC 不需要认证
+	PAC *PACConfig
+
+	// 连接 socks5 服务端使用的 Dialer, 为空时按 socks5Config 新建; 可以与本地 socks5 服务共享, 由调用方关闭
+	Dialer *Dialer
+}
+
 type httpProxy struct {
 	stopCh   chan struct{}
 	listener net.Listener
+	config   *HttpProxyConfig
+	// 转发普通 http 请求的空闲隧道, 为空时每个客户端连接使用自己的隧道池
+	tunnels *httpTunnelPool
 	// socks client
 	socksClient  *client
 	socks5Config *ClientConfig
+	// 通过 socks5Config 的服务端连接目标, 开启多路复用时共享会话
+	dialer *Dialer
+
+	// 连接目标, 为空时通过 socks5Config 的 socks5 服务端连接
+	dial func(conn net.Conn, user httpUser, host string, port int) (net.Conn, error)
+	// 校验 Proxy-Authorization 请求头, 返回认证的用户, 为空时不认证
+	auth func(conn net.Conn, proxyAuth string) (httpUser, error)
+	// authBasic 使用的用户名密码校验
+	credentials CredentialStore
 }
 
-func NewHttpProxy(config *ClientConfig) *httpProxy {
-	return &httpProxy{
+// NewHttpProxy config 为空时使用默认选项
+func NewHttpProxy(socks5Config *ClientConfig, config *HttpProxyConfig) *httpProxy {
+	if config == nil {
+		config = &HttpProxyConfig{}
+	}
+
+	p := &httpProxy{
+		config:       config,
+		tunnels:      newHttpTunnelPool(),
 		socksClient:  nil,
-		socks5Config: config,
+		socks5Config: socks5Config,
+		credentials:  config.Credentials,
 	}
+
+	if config.Dialer != nil {
+		p.dialer = config.Dialer
+	} else if socks5Config != nil {
+		p.dialer = NewDialer(socks5Config)
+	}
+
+	if p.credentials == nil && config.PassThroughAuth {
+		p.credentials = NewCachedCredentialStore(&socksCredentials{dialer: p.dialer}, httpPassThroughCacheTTL)
+	}
+	if p.credentials != nil {
+		p.auth = p.authBasic
+	}
+
+	return p
 }
 
 func (p *httpProxy) Stop() {
-	close(p.stopCh)
-	p.listener.Close()
+	// 服务端同一端口上的 http 代理没有自己的监听和隧道池, 由服务端停止
+	if p.listener != nil {
+		close(p.stopCh)
+		p.listener.Close()
+	}
+	if p.tunnels != nil {
+		p.tunnels.close()
+	}
+	if p.dialer != nil && p.config.Dialer == nil {
+		_ = p.dialer.Close()
+	}
 }
 
-func (p *httpProxy) writeHttpConnect(conn net.Conn, status int) error {
-	_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d Connection established\r\n\r\n", status)))
+func (p *httpProxy) writeHttpConnect(conn net.Conn) error {
+	_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 	if err != nil {
 		log.Printf("write http connect error: %v\n", err)
 		return err
@@ -41,231 +110,338 @@ func (p *httpProxy) writeHttpConnect(conn net.Conn, status int) error {
 	return nil
 }
 
+// writeHttpError 返回错误响应, 之后连接会被关闭
+func (p *httpProxy) writeHttpError(conn net.Conn, status int) error {
+	header := ""
+	if status == http.StatusProxyAuthRequired {
+		header = "Proxy-Authenticate: Basic realm=\"socks-fly\"\r\n"
+	}
+
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), header)
+	if err != nil {
+		log.Printf("write http error response error: %v\n", err)
+	}
+	return err
+}
+
 const (
-	headerKeyMethod = "_method_"
-	headerKeyUrl    = "_url_"
-	headerKeyVer    = "_ver_"
+	headerSplitter  = "\r\n\r\n"
+	defaultHttpPort = 80
+
+	// 客户端连接上两个请求之间的最长空闲时间
+	httpKeepAliveTimeout = 60 * time.Second
 )
 
-func (p *httpProxy) parseHttpHeader(header []byte) map[string]string {
-	headerMap := make(map[string]string)
-	lines := strings.Split(string(header), "\r\n")
+// hop-by-hop 请求头, 只对当前连接有效, 转发时去掉
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	if len(lines) == 0 {
-		return headerMap
+// removeHopHeaders 去掉 hop-by-hop 请求头以及 Connection 中列出的请求头
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
 	}
 
-	// menthod url version
-	line0Parts := strings.Split(lines[0], " ")
-	if len(line0Parts) < 3 {
-		return headerMap
+	for _, name := range hopHeaders {
+		h.Del(name)
 	}
+}
 
-	headerMap[headerKeyMethod] = line0Parts[0]
-	headerMap[headerKeyUrl] = line0Parts[1]
-	headerMap[headerKeyVer] = line0Parts[2]
+// parseBasicAuth 解析 "Basic base64(user:password)"
+func parseBasicAuth(auth string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
 
-	return headerMap
+	return strings.Cut(string(c), ":")
 }
 
-const (
-	bufferSize      = 64
-	headerSplitter  = "\r\n\r\n"
-	defaultHttpPort = 80
-)
+// httpErrorStatus 连接目标失败时返回给客户端的状态码
+func httpErrorStatus(err error) int {
+	var netErr net.Error
 
-func (p *httpProxy) readHttpHeader(conn net.Conn) ([]byte, map[string]string, error) {
-	partBody := make([]byte, 0) // 读取了部分body
+	switch {
+	case errors.Is(err, errConnectionNotAllowed):
+		return http.StatusForbidden
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (p *httpProxy) Start(addr string, ch chan struct{}) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	p.listener = lis
+	p.stopCh = ch
 
-	// 循环读取 如果读取到了 \r\n\r\n 说明头部读取完毕
 	for {
-		buf := make([]byte, bufferSize)
-		n, err := conn.Read(buf)
+		conn, err := lis.Accept()
 		if err != nil {
-			return nil, nil, err
+			select {
+			case <-p.stopCh:
+				return nil
+			default:
+			}
+
+			log.Printf("accept error: %v\n", err)
+			continue
 		}
 
-		partBody = append(partBody, buf[:n]...)
+		log.Printf("client connected: %s\n", conn.RemoteAddr().String())
 
-		if n < bufferSize || bytes.Contains(buf[:n], []byte(headerSplitter)) {
-			break
-		}
+		go p.serveConn(conn)
 	}
-	splitIndex := bytes.Index(partBody, []byte(headerSplitter))
-	if splitIndex == -1 {
-		return nil, nil, errors.New("http header format error")
+}
+
+// serveConn 处理一个客户端连接, 连接上的请求逐个解析并按各自的目标转发;
+// CONNECT 建立隧道后连接只用于隧道
+func (p *httpProxy) serveConn(conn net.Conn) {
+	tunnels := p.tunnels
+	if tunnels == nil {
+		tunnels = newHttpTunnelPool()
+		defer tunnels.close()
 	}
 
-	header := p.parseHttpHeader(partBody[0:splitIndex])
-	return partBody, header, nil
+	br := bufio.NewReader(conn)
+	for first := true; ; first = false {
+		if !first {
+			_ = conn.SetReadDeadline(time.Now().Add(httpKeepAliveTimeout))
+		}
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			var netErr net.Error
+			if err != io.EOF && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				log.Printf("read http request error: %v\n", err)
+				_ = p.writeHttpError(conn, http.StatusBadRequest)
+			}
+			_ = conn.Close()
+			return
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+
+		if p.config.PAC != nil && isPACRequest(req) {
+			if !p.servePAC(conn, req) {
+				_ = conn.Close()
+				return
+			}
+			continue
+		}
+
+		var user httpUser
+		if p.auth != nil {
+			user, err = p.auth(conn, req.Header.Get("Proxy-Authorization"))
+			if err != nil {
+				log.Printf("http auth %s error: %v\n", conn.RemoteAddr().String(), err)
+				status := http.StatusProxyAuthRequired
+				if !errors.Is(err, errHttpAuthFailed) {
+					status = http.StatusBadGateway
+				}
+				_ = p.writeHttpError(conn, status)
+				_ = conn.Close()
+				return
+			}
+		}
+
+		if req.Method == http.MethodConnect {
+			// 客户端可能在收到应答前就发送隧道数据, 已读到缓冲区的数据也要转发
+			p.serveConnect(&bufferedConn{Conn: conn, r: br}, req, user)
+			return
+		}
+
+		if !p.forwardHttp(conn, req, user, tunnels) {
+			_ = conn.Close()
+			return
+		}
+	}
 }
 
-func (p *httpProxy) readHttpConnect(conn net.Conn) (string, int, error) {
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+// serveConnect 建立 CONNECT 隧道, 目标为 authority-form 的 host:port
+func (p *httpProxy) serveConnect(conn net.Conn, req *http.Request, user httpUser) {
+	host := req.URL.Hostname()
+	port, err := strconv.Atoi(req.URL.Port())
+	if host == "" || err != nil {
+		log.Printf("http connect target format error: %s\n", req.RequestURI)
+		_ = p.writeHttpError(conn, http.StatusBadRequest)
+		_ = conn.Close()
+		return
+	}
+
+	log.Printf("accquire http connect: %s:%d\n", host, port)
+
+	remoteConn, err := p.dialRemote(conn, user, host, port)
 	if err != nil {
-		return "", 0, err
+		log.Printf("connect domain %s:%d error: %v\n", host, port, err)
+		_ = p.writeHttpError(conn, httpErrorStatus(err))
+		_ = conn.Close()
+		return
 	}
 
-	// parse connect packet
-	lines := strings.Split(string(buf[:n]), "\r\n")
-	if len(lines) < 1 {
-		return "", 0, errors.New("http connect packet is empty")
+	if err := p.writeHttpConnect(conn); err != nil {
+		_ = conn.Close()
+		_ = remoteConn.Close()
+		return
 	}
+	p.transfer(conn, remoteConn, p.stopCh)
+}
 
-	for _, line := range lines {
-		fmt.Printf("line: %s\n", line)
+// forwardHttp 转发普通 http 请求: absolute-form 转成 origin-form, 去掉 hop-by-hop 请求头,
+// 请求体按 Content-Length 或 chunked 原样转发; 返回客户端连接是否可以继续读取下一个请求
+func (p *httpProxy) forwardHttp(conn net.Conn, req *http.Request, user httpUser, tunnels *httpTunnelPool) bool {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		log.Printf("http proxy request uri not supported: %s\n", req.RequestURI)
+		_ = p.writeHttpError(conn, http.StatusBadRequest)
+		return false
 	}
 
-	// 解析第一行
-	// 格式 CONNECT www.baidu.com:443 HTTP/1.1
-	parts := strings.Split(lines[0], " ")
-	if len(parts) < 3 {
-		return "", 0, errors.New("http connect packet format error")
+	host := req.URL.Hostname()
+	port := defaultHttpPort
+	if req.URL.Port() != "" {
+		var err error
+		if port, err = strconv.Atoi(req.URL.Port()); err != nil {
+			_ = p.writeHttpError(conn, http.StatusBadRequest)
+			return false
+		}
 	}
 
-	// 解析域名和端口
-	hostPort := strings.Split(parts[1], ":")
-	if len(hostPort) < 2 {
-		return "", 0, errors.New("http connect packet host port format error")
+	log.Printf("acquire http proxy: %s:%d\n", host, port)
+
+	// 由代理回复 100 Continue, 避免客户端等待
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Header.Del("Expect")
+		if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return false
+		}
 	}
 
-	host := hostPort[0]
-	port, err := strconv.Atoi(hostPort[1])
+	keepAlive := !req.Close
+	p.prepareRequest(conn, req)
+
+	resp, tunnel, err := p.roundTrip(conn, req, user, host, port, tunnels)
 	if err != nil {
-		return "", 0, err
+		log.Printf("http proxy %s:%d error: %v\n", host, port, err)
+		_ = p.writeHttpError(conn, httpErrorStatus(err))
+		return false
 	}
+	defer resp.Body.Close()
 
-	return host, port, nil
-}
+	reusable := !resp.Close
+	removeHopHeaders(resp.Header)
 
-func (p *httpProxy) printHttpPacket(conn net.Conn) error {
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		log.Printf("read error: %v\n", err)
-		return err
+	// 响应体以关闭连接结束时, 客户端也只能通过关闭连接得知响应结束
+	if resp.ContentLength < 0 && !isChunked(resp.TransferEncoding) {
+		keepAlive = false
 	}
-	log.Printf("http packet:\n %s\n", string(buf[:n]))
-	return nil
-}
+	resp.Close = !keepAlive
 
-func (p *httpProxy) Start(addr string, ch chan struct{}) error {
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	if err := resp.Write(conn); err != nil {
+		log.Printf("write http response error: %v\n", err)
+		_ = tunnel.conn.Close()
+		return false
 	}
 
-	p.listener = lis
-	p.stopCh = ch
+	if reusable {
+		tunnels.put(tunnel)
+	} else {
+		_ = tunnel.conn.Close()
+	}
+	return keepAlive
+}
 
-	var conn net.TCPConn
-	conn.Close()
+// roundTrip 通过到目标的隧道发送请求并读取响应头, 优先复用空闲隧道;
+// 复用的隧道可能已被目标关闭, 请求没有请求体时换一条新隧道重试
+func (p *httpProxy) roundTrip(conn net.Conn, req *http.Request, user httpUser, host string, port int, tunnels *httpTunnelPool) (*http.Response, *httpTunnel, error) {
+	key := user.name + "@" + net.JoinHostPort(host, strconv.Itoa(port))
 
 	for {
-		select {
-		case <-p.stopCh:
-			return nil
-		default:
-			conn, err := lis.Accept()
+		tunnel := tunnels.get(key)
+		reused := tunnel != nil
+		if !reused {
+			remoteConn, err := p.dialRemote(conn, user, host, port)
 			if err != nil {
-				log.Printf("accept error: %v\n", err)
-				continue
+				return nil, nil, err
 			}
+			tunnel = newHttpTunnel(key, remoteConn)
+		}
 
-			log.Printf("client connected: %s\n", conn.RemoteAddr().String())
+		resp, err := tunnel.roundTrip(req)
+		if err == nil {
+			return resp, tunnel, nil
+		}
 
-			go func(_conn net.Conn) {
-				body, header, err := p.readHttpHeader(_conn)
-				if err != nil {
-					log.Printf("read http header error: %v\n", err)
-					return
-				}
+		_ = tunnel.conn.Close()
+		if !reused || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, nil, err
+		}
+		log.Printf("idle tunnel to %s broken, retry: %v\n", key, err)
+	}
+}
 
-				log.Printf("http header: %v\n", header)
-
-				if header[headerKeyMethod] == "CONNECT" {
-					host := header[headerKeyUrl]
-					hsp := strings.Split(host, ":")
-					if len(hsp) < 2 {
-						_conn.Close()
-						log.Printf("host port format error\n")
-						return
-					}
-
-					port, err := strconv.Atoi(hsp[1])
-					if err != nil {
-						_conn.Close()
-						log.Printf("port format error: %v\n", err)
-						return
-					}
-					host = hsp[0]
-
-					log.Printf("accquire http connect: %s:%d\n", host, port)
-
-					socksCli := NewClient(p.socks5Config)
-					if err := socksCli.Open(); err != nil {
-						log.Printf("open socks5 client error: %v\n", err)
-						p.writeHttpConnect(_conn, 502)
-						_conn.Close()
-						return
-					}
-
-					log.Printf("open socks5 client success\n")
-
-					err = socksCli.ConnectDomain(host, port)
-					if err != nil {
-						log.Printf("connect domain %s:%d error: %v\n", host, port, err)
-						p.writeHttpConnect(_conn, 502)
-						_conn.Close()
-						return
-					}
-
-					log.Printf("connect domain success\n")
-					p.writeHttpConnect(_conn, 200)
-					log.Printf("start transfer\n")
-					p.transfer(_conn, socksCli.conn, p.stopCh)
-				} else {
-					// http proxy
-					log.Printf("http proxy\n")
-					host := header[headerKeyUrl]
-					parsedUrl, err := url.Parse(host)
-					if err != nil {
-						log.Printf("parse url error: %v\n", err)
-						_conn.Close()
-						return
-					}
-
-					host = parsedUrl.Host
-					port, _ := strconv.Atoi(parsedUrl.Port())
-					if port == 0 {
-						port = defaultHttpPort
-					}
-
-					log.Printf("acquire http proxy: %s:%d\n", host, port)
-
-					socksCli := NewClient(p.socks5Config)
-					if err := socksCli.Open(); err != nil {
-						log.Printf("open socks5 client error: %v\n", err)
-						_conn.Close()
-						return
-					}
-
-					log.Printf("open socks5 client success\n")
-					if err := socksCli.ConnectDomain(host, port); err != nil {
-						log.Printf("connect domain error: %v\n", err)
-						_conn.Close()
-						return
-					}
-
-					socksCli.conn.Write(body)
-					p.transfer(_conn, socksCli.conn, p.stopCh)
-				}
-			}(conn)
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// prepareRequest 处理转发给目标的请求头
+func (p *httpProxy) prepareRequest(conn net.Conn, req *http.Request) {
+	removeHopHeaders(req.Header)
+
+	// 客户端没有 User-Agent 时不要添加 Go 默认的 User-Agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+
+	if p.config.Via {
+		req.Header.Add("Via", fmt.Sprintf("%d.%d socks-fly", req.ProtoMajor, req.ProtoMinor))
+	}
+
+	if p.config.XForwardedFor {
+		if ip, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+				ip = prior + ", " + ip
+			}
+			req.Header.Set("X-Forwarded-For", ip)
 		}
 	}
 
-	return nil
+	// 到目标的连接由隧道池管理, 与客户端是否保持连接无关
+	req.Close = false
+}
+
+// dialRemote 连接目标, 未设置 dial 时通过 socks5 服务端连接
+func (p *httpProxy) dialRemote(conn net.Conn, user httpUser, host string, port int) (net.Conn, error) {
+	if p.dial != nil {
+		return p.dial(conn, user, host, port)
+	}
+
+	dialer := p.dialer
+	if p.config.PassThroughAuth && user.name != "" {
+		dialer = dialer.withCredentials(user.name, user.password)
+	}
+
+	return dialer.DialContext(context.Background(), "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 }
 
 func (p *httpProxy) transfer(f, t net.Conn, stopCh chan struct{}) {
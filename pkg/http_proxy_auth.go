@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// 透传认证时, 在 socks5 服务端校验通过的用户名密码的缓存时间
+const httpPassThroughCacheTTL = time.Minute
+
+// httpUser 通过 Proxy-Authorization 认证的用户, 未认证时为空
+type httpUser struct {
+	name     string
+	password string
+}
+
+// authBasic 用本地用户校验 Basic 认证的用户名密码, 认证失败返回 errHttpAuthFailed
+func (p *httpProxy) authBasic(conn net.Conn, proxyAuth string) (httpUser, error) {
+	name, password, ok := parseBasicAuth(proxyAuth)
+	if !ok {
+		return httpUser{}, errHttpAuthFailed
+	}
+
+	ok, err := p.credentials.Verify(name, password)
+	if err != nil {
+		log.Printf("verify http user %s error: %v\n", name, err)
+		return httpUser{}, err
+	}
+	if !ok {
+		return httpUser{}, errHttpAuthFailed
+	}
+
+	return httpUser{name: name, password: password}, nil
+}
+
+// socksCredentials 在 socks5 服务端校验用户名密码, 用该用户名密码完成握手和认证即为通过;
+// 认证失败时不换服务端重试
+type socksCredentials struct {
+	dialer *Dialer
+}
+
+func (c *socksCredentials) Verify(username, password string) (bool, error) {
+	conn, err := c.dialer.withCredentials(username, password).dial(context.Background(), nil)
+	if errors.Is(err, ErrAuthFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_ = conn.Close()
+	return true, nil
+}
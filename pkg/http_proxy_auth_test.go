@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// 设置了 Credentials 时要求 Proxy-Authorization, 用本地用户校验
+func TestHttpProxyAuthBasic(t *testing.T) {
+	echo := startEchoServer(t)
+	addr := startHttpProxy(t, &HttpProxyConfig{Credentials: &staticCredentials{user: "alice", password: "secret"}})
+
+	for _, tt := range []struct {
+		auth string
+		code int
+	}{
+		{auth: "", code: http.StatusProxyAuthRequired},
+		{auth: "alice:wrong", code: http.StatusProxyAuthRequired},
+		{auth: "alice:secret", code: http.StatusOK},
+	} {
+		if _, _, code := httpConnect(t, addr, echo, tt.auth); code != tt.code {
+			t.Fatalf("auth %q: status %d, want %d", tt.auth, code, tt.code)
+		}
+	}
+}
+
+// 透传认证时用 Proxy-Authorization 的用户名密码登录 socks5 服务端
+func TestHttpProxyAuthPassThrough(t *testing.T) {
+	echo := startEchoServer(t)
+	socksAddr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+
+	config := testClientConfig(t, socksAddr)
+	config.AuthMethod = socks5.Socks5MethodUserPass
+	addr := serveHttpProxy(t, NewHttpProxy(config, &HttpProxyConfig{PassThroughAuth: true}))
+
+	for _, tt := range []struct {
+		auth string
+		code int
+	}{
+		{auth: "", code: http.StatusProxyAuthRequired},
+		{auth: "u:wrong", code: http.StatusProxyAuthRequired},
+		{auth: "u:p", code: http.StatusOK},
+	} {
+		conn, r, code := httpConnect(t, addr, echo, tt.auth)
+		if code != tt.code {
+			t.Fatalf("auth %q: status %d, want %d", tt.auth, code, tt.code)
+		}
+		if code == http.StatusOK {
+			if _, err := conn.Write([]byte("through")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len("through"))
+			if _, err := io.ReadFull(r, got); err != nil || string(got) != "through" {
+				t.Fatalf("tunnel echo: %q, %v", got, err)
+			}
+		}
+	}
+}
+
+// 透传认证用户的密码错误不换服务端重试, 也不影响服务端的健康状态
+func TestSocksCredentialsVerify(t *testing.T) {
+	var relays []*testRelay
+	var servers []RemoteServer
+	for i := 0; i < 2; i++ {
+		addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "user", Password: "pass"})
+		relay := startTestRelay(t, addr)
+		relays = append(relays, relay)
+		servers = append(servers, relay.remoteServer())
+	}
+
+	d := NewDialer(&ClientConfig{AuthMethod: socks5.Socks5MethodUserPass, RemoteServers: servers})
+	defer d.Close()
+	creds := &socksCredentials{dialer: d}
+
+	ok, err := creds.Verify("user", "wrong")
+	if ok || err != nil {
+		t.Fatalf("verify wrong password: %v, %v", ok, err)
+	}
+	if n := relays[0].accepted.Load() + relays[1].accepted.Load(); n != 1 {
+		t.Fatalf("wrong password tried on %d servers", n)
+	}
+	for _, r := range d.remotes.remotes {
+		if r.failures != 0 {
+			t.Fatalf("server %s marked unhealthy by wrong password", r.server)
+		}
+	}
+
+	ok, err = creds.Verify("user", "pass")
+	if !ok || err != nil {
+		t.Fatalf("verify password: %v, %v", ok, err)
+	}
+	// 与 d 共享服务端状态
+	var rtts int
+	for _, r := range d.remotes.remotes {
+		if r.rtt != 0 {
+			rtts++
+		}
+	}
+	if rtts == 0 {
+		t.Fatal("verify did not use the shared balancer")
+	}
+}
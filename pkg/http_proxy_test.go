@@ -0,0 +1,223 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startHttpProxy 启动直连目标的 http 代理
+func startHttpProxy(t *testing.T, config *HttpProxyConfig) string {
+	t.Helper()
+
+	p := NewHttpProxy(nil, config)
+	p.dial = func(_ net.Conn, _ httpUser, host string, port int) (net.Conn, error) {
+		return net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return serveHttpProxy(t, p)
+}
+
+// serveHttpProxy 在空闲端口上用 p 处理连接, 返回地址
+func serveHttpProxy(t *testing.T, p *httpProxy) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serveConn(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxyRoundTrip 向代理发送原始请求 raw, 返回响应
+func proxyRoundTrip(t *testing.T, addr, raw string) *http.Response {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	return resp
+}
+
+// 转发时请求行改为 origin-form, 去掉 hop-by-hop 请求头, chunked 请求体完整转发
+func TestHttpProxyForward(t *testing.T) {
+	type received struct {
+		uri    string
+		header http.Header
+		body   string
+	}
+	recvCh := make(chan received, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		recvCh <- received{uri: r.RequestURI, header: r.Header.Clone(), body: string(body)}
+
+		w.Header().Set("Keep-Alive", "timeout=5")
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	addr := startHttpProxy(t, nil)
+	host := target.Listener.Addr().String()
+	raw := fmt.Sprintf("POST %s/path?q=1 HTTP/1.1\r\nHost: %s\r\n"+
+		"Proxy-Authorization: Basic dTpw\r\nProxy-Connection: keep-alive\r\n"+
+		"Connection: X-Custom\r\nX-Custom: drop\r\nX-Keep: keep\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", target.URL, host)
+
+	resp := proxyRoundTrip(t, addr, raw)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("response: %d %q", resp.StatusCode, body)
+	}
+	if v := resp.Header.Get("Keep-Alive"); v != "" {
+		t.Errorf("response header Keep-Alive forwarded: %q", v)
+	}
+
+	got := <-recvCh
+	if got.uri != "/path?q=1" {
+		t.Errorf("request uri: %q, want origin-form", got.uri)
+	}
+	if got.body != "hello world" {
+		t.Errorf("request body: %q", got.body)
+	}
+	for _, h := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Custom"} {
+		if v := got.header.Get(h); v != "" {
+			t.Errorf("request header %s forwarded: %q", h, v)
+		}
+	}
+	if got.header.Get("X-Keep") != "keep" {
+		t.Errorf("end-to-end header dropped: %v", got.header)
+	}
+	if _, ok := got.header["User-Agent"]; ok {
+		t.Errorf("user agent added: %q", got.header.Get("User-Agent"))
+	}
+}
+
+func TestHttpProxyForwardHeaders(t *testing.T) {
+	headerCh := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerCh <- r.Header.Clone()
+	}))
+	defer target.Close()
+
+	addr := startHttpProxy(t, &HttpProxyConfig{Via: true, XForwardedFor: true})
+	raw := fmt.Sprintf("GET %s/ HTTP/1.1\r\nHost: %s\r\nX-Forwarded-For: 192.0.2.1\r\n\r\n", target.URL, target.Listener.Addr())
+	if resp := proxyRoundTrip(t, addr, raw); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: %d", resp.StatusCode)
+	}
+
+	h := <-headerCh
+	if via := h.Get("Via"); via != "1.1 socks-fly" {
+		t.Errorf("via: %q", via)
+	}
+	if xff := h.Get("X-Forwarded-For"); xff != "192.0.2.1, 127.0.0.1" {
+		t.Errorf("x-forwarded-for: %q", xff)
+	}
+}
+
+func TestHttpProxyBadRequest(t *testing.T) {
+	addr := startHttpProxy(t, nil)
+
+	for _, raw := range []string{
+		// origin-form 不是代理请求
+		"GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET ftp://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		if resp := proxyRoundTrip(t, addr, raw); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want %d", strings.SplitN(raw, "\r\n", 2)[0], resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// 同一客户端连接和不同客户端连接上发往同一目标的请求复用空闲隧道
+func TestHttpProxyTunnelReuse(t *testing.T) {
+	var mu sync.Mutex
+	var conns int
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	target.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	target.Start()
+	defer target.Close()
+
+	addr := startHttpProxy(t, nil)
+	raw := fmt.Sprintf("GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target.URL, target.Listener.Addr())
+
+	get := func(conn net.Conn, br *bufio.Reader) {
+		t.Helper()
+
+		if _, err := io.WriteString(conn, raw); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Fatalf("response: %d %q", resp.StatusCode, body)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		get(conn, br)
+		get(conn, br)
+		_ = conn.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Fatalf("target connections: %d, want 1", conns)
+	}
+}
@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个目标最多保留的空闲隧道数
+	httpTunnelMaxIdle = 4
+	// 空闲隧道的保留时间, 超时后关闭
+	httpTunnelIdleTimeout = 90 * time.Second
+)
+
+// httpTunnel 转发普通 http 请求用的到目标的连接, 响应读完且双方都未要求关闭时可以复用
+type httpTunnel struct {
+	key   string
+	conn  net.Conn
+	br    *bufio.Reader
+	timer *time.Timer
+}
+
+func newHttpTunnel(key string, conn net.Conn) *httpTunnel {
+	return &httpTunnel{key: key, conn: conn, br: bufio.NewReader(conn)}
+}
+
+// roundTrip 发送请求并读取响应头, 跳过 1xx 中间响应
+func (t *httpTunnel) roundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Write(t.conn); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := http.ReadResponse(t.br, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// httpTunnelPool 按用户和目标 host:port 缓存空闲隧道, 供同一客户端或其他客户端后续的请求复用
+type httpTunnelPool struct {
+	mu     sync.Mutex
+	idle   map[string][]*httpTunnel
+	closed bool
+}
+
+func newHttpTunnelPool() *httpTunnelPool {
+	return &httpTunnelPool{idle: make(map[string][]*httpTunnel)}
+}
+
+// get 取出最近放回的空闲隧道, 没有时返回 nil
+func (p *httpTunnelPool) get(key string) *httpTunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tunnels := p.idle[key]
+	if len(tunnels) == 0 {
+		return nil
+	}
+
+	t := tunnels[len(tunnels)-1]
+	p.removeLocked(t)
+	t.timer.Stop()
+	return t
+}
+
+// put 放回空闲隧道, 超过数量上限时关闭最早放回的隧道
+func (p *httpTunnelPool) put(t *httpTunnel) {
+	// 响应之后还有多余的数据, 说明连接状态不对, 不再复用
+	if t.br.Buffered() > 0 {
+		_ = t.conn.Close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = t.conn.Close()
+		return
+	}
+
+	if tunnels := p.idle[t.key]; len(tunnels) >= httpTunnelMaxIdle {
+		oldest := tunnels[0]
+		p.removeLocked(oldest)
+		oldest.timer.Stop()
+		_ = oldest.conn.Close()
+	}
+
+	p.idle[t.key] = append(p.idle[t.key], t)
+	t.timer = time.AfterFunc(httpTunnelIdleTimeout, func() {
+		p.mu.Lock()
+		removed := p.removeLocked(t)
+		p.mu.Unlock()
+
+		if removed {
+			_ = t.conn.Close()
+		}
+	})
+}
+
+func (p *httpTunnelPool) removeLocked(t *httpTunnel) bool {
+	tunnels := p.idle[t.key]
+	for i, it := range tunnels {
+		if it != t {
+			continue
+		}
+
+		tunnels = append(tunnels[:i], tunnels[i+1:]...)
+		if len(tunnels) == 0 {
+			delete(p.idle, t.key)
+		} else {
+			p.idle[t.key] = tunnels
+		}
+		return true
+	}
+	return false
+}
+
+// close 关闭所有空闲隧道, 之后放回的隧道直接关闭
+func (p *httpTunnelPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, tunnels := range p.idle {
+		for _, t := range tunnels {
+			t.timer.Stop()
+			_ = t.conn.Close()
+		}
+	}
+	p.idle = make(map[string][]*httpTunnel)
+}
@@ -0,0 +1,541 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// 多路复用帧格式: VER(1) CMD(1) LEN(2) STREAM_ID(4) DATA(LEN), 整数为大端序.
+// 客户端发送 MUX 命令并收到成功应答后, 该连接切换为多路复用帧, 只有客户端新建流 (奇数 ID);
+// 每个流开始时按 socks5 命令请求格式发送 CONNECT, 服务端应答后转发数据.
+// 流控按流进行: 发送方最多发送 muxWindowSize 未确认的数据, 接收方读走一半窗口后用 UPD 归还额度.
+// 服务端对偶数 ID 或超过流数量上限的 SYN 回复 RST, 客户端收到后该流的读写返回错误
+const (
+	muxVersion    = 1
+	muxHeaderSize = 8
+
+	muxCmdSYN  byte = 0 // 新建流
+	muxCmdFIN  byte = 1 // 关闭流
+	muxCmdPSH  byte = 2 // 数据
+	muxCmdUPD  byte = 3 // 窗口更新, DATA 为 4 字节的归还额度
+	muxCmdPING byte = 4 // 心跳, STREAM_ID 为 0
+	muxCmdRST  byte = 5 // 拒绝新建流
+
+	muxMaxFrameSize = 16 * 1024
+	muxWindowSize   = 256 * 1024
+
+	// 每隔 muxKeepAliveInterval 发送心跳, muxKeepAliveTimeout 内没有收到任何帧时关闭会话
+	muxKeepAliveInterval = 10 * time.Second
+	muxKeepAliveTimeout  = 30 * time.Second
+
+	// 服务端等待 accept 的新建流数量
+	muxAcceptBacklog = 64
+	// 服务端一个会话同时打开的流数量上限, 见 ServerConfig.MuxMaxStreams
+	muxDefaultMaxStreams = 256
+)
+
+// socks5CmdMux 私有命令, 请求多路复用会话, 地址字段不使用
+const socks5CmdMux socks5.Socks5Cmd = 0x7f
+
+var (
+	errMuxSessionClosed  = errors.New("mux session closed")
+	errMuxWindowExceeded = errors.New("mux stream window exceeded")
+	errMuxStreamReset    = errors.New("mux stream reset by peer")
+)
+
+// muxSession 一个底层连接上的多路复用会话
+type muxSession struct {
+	conn   net.Conn
+	client bool
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	// 服务端同时打开的流数量上限
+	maxStreams int
+
+	acceptCh chan *muxStream
+	writeMu  sync.Mutex
+
+	dieCh   chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+
+	// 最后收到帧的时间, unix 纳秒
+	lastRecv atomic.Int64
+}
+
+// newMuxSession client 为 true 时可以新建流, 否则只能接受对端新建的流, 最多同时打开 maxStreams 个,
+// maxStreams 不大于 0 时使用 muxDefaultMaxStreams
+func newMuxSession(conn net.Conn, client bool, maxStreams int) *muxSession {
+	if maxStreams <= 0 {
+		maxStreams = muxDefaultMaxStreams
+	}
+	s := &muxSession{
+		conn:       conn,
+		client:     client,
+		streams:    make(map[uint32]*muxStream),
+		nextID:     1,
+		maxStreams: maxStreams,
+		acceptCh:   make(chan *muxStream, muxAcceptBacklog),
+		dieCh:      make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+// openStream 新建流, 只有客户端可以调用
+func (s *muxSession) openStream() (*muxStream, error) {
+	if !s.client {
+		return nil, errors.New("mux stream can only be opened by client")
+	}
+
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, s.err()
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxCmdSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// acceptStream 等待客户端新建的流, 会话关闭时返回错误
+func (s *muxSession) acceptStream() (*muxStream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.dieCh:
+		return nil, s.err()
+	}
+}
+
+// numStreams 未关闭的流数量
+func (s *muxSession) numStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) getStream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) writeFrame(cmd byte, id uint32, data []byte) error {
+	frame := make([]byte, muxHeaderSize+len(data))
+	frame[0] = muxVersion
+	frame[1] = cmd
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	copy(frame[muxHeaderSize:], data)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.isClosed() {
+		return s.err()
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) writeWindowUpdate(id uint32, n uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, n)
+	return s.writeFrame(muxCmdUPD, id, data)
+}
+
+func (s *muxSession) recvLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		if header[0] != muxVersion {
+			s.closeWithErr(errors.New("mux version not support"))
+			return
+		}
+
+		cmd := header[1]
+		id := binary.BigEndian.Uint32(header[4:])
+		data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+
+		switch cmd {
+		case muxCmdSYN:
+			if s.client {
+				continue
+			}
+			s.mu.Lock()
+			if _, ok := s.streams[id]; ok {
+				s.mu.Unlock()
+				continue
+			}
+			// 客户端新建的流为奇数 ID
+			if id%2 == 0 || len(s.streams) >= s.maxStreams {
+				s.mu.Unlock()
+				_ = s.writeFrame(muxCmdRST, id, nil)
+				continue
+			}
+			st := newMuxStream(id, s)
+			s.streams[id] = st
+			s.mu.Unlock()
+
+			select {
+			case s.acceptCh <- st:
+			case <-s.dieCh:
+				return
+			}
+
+		case muxCmdFIN:
+			if st := s.getStream(id); st != nil {
+				st.remoteClose()
+			}
+
+		case muxCmdRST:
+			if st := s.getStream(id); st != nil {
+				st.remoteReset()
+			}
+
+		case muxCmdPSH:
+			if st := s.getStream(id); st != nil {
+				if err := st.pushData(data); err != nil {
+					s.closeWithErr(err)
+					return
+				}
+			}
+
+		case muxCmdUPD:
+			if len(data) != 4 {
+				s.closeWithErr(errors.New("invalid mux window update"))
+				return
+			}
+			if st := s.getStream(id); st != nil {
+				st.addWindow(int(binary.BigEndian.Uint32(data)))
+			}
+
+		case muxCmdPING:
+
+		default:
+			s.closeWithErr(errors.New("mux command not support"))
+			return
+		}
+	}
+}
+
+// keepalive 定时发送心跳, 对端长时间没有任何帧时关闭会话
+func (s *muxSession) keepalive() {
+	ticker := time.NewTicker(muxKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.lastRecv.Load())) > muxKeepAliveTimeout {
+				s.closeWithErr(errors.New("mux keepalive timeout"))
+				return
+			}
+			_ = s.writeFrame(muxCmdPING, 0, nil)
+		case <-s.dieCh:
+			return
+		}
+	}
+}
+
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.dieCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) err() error {
+	if s.dieErr != nil && s.dieErr != io.EOF {
+		return s.dieErr
+	}
+	return errMuxSessionClosed
+}
+
+func (s *muxSession) closeWithErr(err error) {
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.dieCh)
+		_ = s.conn.Close()
+	})
+}
+
+// close 关闭会话和底层连接, 所有流随之关闭
+func (s *muxSession) close() error {
+	s.closeWithErr(errMuxSessionClosed)
+	return nil
+}
+
+// muxStream 会话上的一个流, 实现 net.Conn
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu sync.Mutex
+	// 收到未读的数据
+	buf bytes.Buffer
+	// 已读但未归还给对端的额度
+	consumed int
+	// 还可以发送的额度
+	sendWindow int
+	// 对端已关闭
+	remoteClosed bool
+	// 对端拒绝了该流
+	reset bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readEvent   chan struct{}
+	windowEvent chan struct{}
+
+	dieCh     chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	return &muxStream{
+		id:          id,
+		sess:        sess,
+		sendWindow:  muxWindowSize,
+		readEvent:   make(chan struct{}, 1),
+		windowEvent: make(chan struct{}, 1),
+		dieCh:       make(chan struct{}),
+	}
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			update := 0
+			if st.consumed >= muxWindowSize/2 {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				_ = st.sess.writeWindowUpdate(st.id, uint32(update))
+			}
+			return n, nil
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return 0, errMuxStreamReset
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		size, err := st.reserve(len(b))
+		if err != nil {
+			return n, err
+		}
+		if err := st.sess.writeFrame(muxCmdPSH, st.id, b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// reserve 等待发送额度, 返回本次可以发送的长度
+func (st *muxStream) reserve(want int) (int, error) {
+	for {
+		select {
+		case <-st.dieCh:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		st.mu.Lock()
+		if st.reset {
+			st.mu.Unlock()
+			return 0, errMuxStreamReset
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if st.sendWindow > 0 {
+			size := min(want, st.sendWindow, muxMaxFrameSize)
+			st.sendWindow -= size
+			st.mu.Unlock()
+			return size, nil
+		}
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.windowEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait 等待 event, 流或会话关闭, 截止时间到达时返回错误
+func (st *muxStream) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-event:
+		return nil
+	case <-st.dieCh:
+		return net.ErrClosed
+	case <-st.sess.dieCh:
+		return st.sess.err()
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// pushData 收到数据; 未归还额度的数据 (未读的和已读未归还的) 超过窗口时对端违反流控, 返回错误
+func (st *muxStream) pushData(data []byte) error {
+	st.mu.Lock()
+	if st.buf.Len()+st.consumed+len(data) > muxWindowSize {
+		st.mu.Unlock()
+		return errMuxWindowExceeded
+	}
+	st.buf.Write(data)
+	st.mu.Unlock()
+	notifyEvent(st.readEvent)
+	return nil
+}
+
+func (st *muxStream) addWindow(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notifyEvent(st.windowEvent)
+}
+
+// remoteClose 对端关闭, 读完已收到的数据后返回 EOF, 之后不能再写
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	notifyEvent(st.readEvent)
+	notifyEvent(st.windowEvent)
+}
+
+// remoteReset 对端拒绝新建该流, 之后读写返回 errMuxStreamReset
+func (st *muxStream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.remoteClosed = true
+	st.mu.Unlock()
+	notifyEvent(st.readEvent)
+	notifyEvent(st.windowEvent)
+}
+
+// Close 通知对端关闭并从会话中移除, 之后收到的帧被丢弃
+func (st *muxStream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.dieCh)
+		st.sess.removeStream(st.id)
+		_ = st.sess.writeFrame(muxCmdFIN, st.id, nil)
+	})
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	// 唤醒等待中的读, 按新的截止时间重新等待
+	notifyEvent(st.readEvent)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notifyEvent(st.windowEvent)
+	return nil
+}
+
+func notifyEvent(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func writeMuxFrame(t *testing.T, conn net.Conn, cmd byte, id uint32, data []byte) error {
+	t.Helper()
+
+	frame := make([]byte, muxHeaderSize+len(data))
+	frame[0] = muxVersion
+	frame[1] = cmd
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	copy(frame[muxHeaderSize:], data)
+	_, err := conn.Write(frame)
+	return err
+}
+
+// 对端不按流控发送时关闭会话, 不无限缓存数据
+func TestMuxWindowExceeded(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+
+	sess := newMuxSession(local, false, 0)
+	defer sess.close()
+
+	if err := writeMuxFrame(t, peer, muxCmdSYN, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.acceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, muxMaxFrameSize)
+	for sent := 0; sent <= muxWindowSize; sent += len(data) {
+		if err := writeMuxFrame(t, peer, muxCmdPSH, 1, data); err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-sess.dieCh:
+	case <-time.After(time.Second):
+		t.Fatal("session not closed after window exceeded")
+	}
+	if !errors.Is(sess.err(), errMuxWindowExceeded) {
+		t.Fatalf("session error: %v", sess.err())
+	}
+}
+
+// 按窗口发送的数据读完后可以继续发送
+func TestMuxWindowUpdate(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := newMuxSession(clientConn, true, 0)
+	server := newMuxSession(serverConn, false, 0)
+	defer client.close()
+	defer server.close()
+
+	st, err := client.openStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.acceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 4 * muxWindowSize
+	go func() {
+		_, _ = st.Write(make([]byte, total))
+	}()
+
+	buf := make([]byte, 32*1024)
+	for n := 0; n < total; {
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		m, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("read after %d bytes: %v", n, err)
+		}
+		n += m
+	}
+}
+
+func readMuxFrame(t *testing.T, conn net.Conn) (byte, uint32) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint16(header[2:]))); err != nil {
+		t.Fatal(err)
+	}
+	return header[1], binary.BigEndian.Uint32(header[4:])
+}
+
+// 偶数 ID 和超过流数量上限的 SYN 被拒绝, 会话不关闭
+func TestMuxStreamRejected(t *testing.T) {
+	local, peer := net.Pipe()
+	defer peer.Close()
+
+	sess := newMuxSession(local, false, 1)
+	defer sess.close()
+
+	for _, tt := range []struct {
+		id     uint32
+		accept bool
+	}{
+		{id: 2, accept: false},
+		{id: 1, accept: true},
+		{id: 3, accept: false},
+	} {
+		if err := writeMuxFrame(t, peer, muxCmdSYN, tt.id, nil); err != nil {
+			t.Fatal(err)
+		}
+		if tt.accept {
+			if _, err := sess.acceptStream(); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if cmd, id := readMuxFrame(t, peer); cmd != muxCmdRST || id != tt.id {
+			t.Fatalf("stream %d: got cmd %d for stream %d, want RST", tt.id, cmd, id)
+		}
+	}
+
+	if sess.isClosed() || sess.numStreams() != 1 {
+		t.Fatalf("session closed: %v, streams: %d", sess.isClosed(), sess.numStreams())
+	}
+}
+
+// 服务端拒绝的流在客户端读写返回错误, 关闭已有的流后可以新建
+func TestMuxMaxStreams(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := newMuxSession(clientConn, true, 0)
+	server := newMuxSession(serverConn, false, 1)
+	defer client.close()
+	defer server.close()
+
+	first, err := client.openStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.acceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := client.openStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, errMuxStreamReset) {
+		t.Fatalf("read on rejected stream: %v", err)
+	}
+	if _, err := second.Write([]byte("x")); !errors.Is(err, errMuxStreamReset) {
+		t.Fatalf("write on rejected stream: %v", err)
+	}
+	_ = second.Close()
+
+	_ = first.Close()
+	_ = accepted.Close()
+	for i := 0; server.numStreams() != 0; i++ {
+		if i == 100 {
+			t.Fatal("stream not removed after close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := client.openStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.acceptStream(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,15 @@
 package pkg
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"time"
 
 	socks5 "github.com/ojbkgo/socks5-protocol"
 )
@@ -18,40 +22,129 @@ const (
 )
 
 type ServerConfig struct {
-	AuthMethod socks5.Socks5Method
-	User       string
-	Password   string
-	Mode       ServerMode
-	Addr       string
-	Port       int
+	// AuthMethods 为空时只支持 AuthMethod
+	AuthMethod  socks5.Socks5Method
+	AuthMethods []socks5.Socks5Method
+	// 按来源地址选择认证方式, 匹配第一个包含来源地址的策略, 都不匹配时使用 AuthMethods
+	AuthPolicies []AuthPolicy
+	User         string
+	Password     string
+	Mode         ServerMode
+	Addr         string
+	Port         int
+
+	// 用户名密码校验, 为空时使用 User/Password
+	Credentials CredentialStore
+	// 访问规则, 为空时不限制
+	ACL *ACL
+	// 上游代理, 为空时直连
+	Upstreams *UpstreamRouter
+
+	// BIND 等待入站连接的超时时间, 为 0 时使用 defaultBindTimeout
+	BindTimeout time.Duration
+	// BIND 监听端口范围, 为 0 时由系统分配
+	BindPortStart int
+	BindPortEnd   int
+
+	// 同一端口同时提供 http 代理 (CONNECT 和普通 http 请求)
+	HttpProxy bool
+
+	// 不为空时监听 tls, 见 NewServerTLSConfig; 客户端证书通过校验时可以不认证 (NoAuth),
+	// 用户名为证书的 CommonName. udp 中继的报文不经过 tls
+	TLSConfig *tls.Config
+
+	// 允许客户端建立多路复用会话, 一个连接上承载多个 CONNECT, 见 ClientConfig.MuxSessions
+	Mux bool
+	// 一个多路复用会话同时打开的流数量上限, 超过时拒绝新建流; 为 0 时使用 muxDefaultMaxStreams
+	MuxMaxStreams int
 }
 
+// AuthPolicy 来源地址在 Network 内时按 Methods 的顺序协商认证方式
+type AuthPolicy struct {
+	Network *net.IPNet
+	Methods []socks5.Socks5Method
+}
+
+// AuthHandler 完成某种认证方式的子协商, 返回认证后的用户名
+type AuthHandler func(conn net.Conn) (string, error)
+
 type server struct {
 	config      *ServerConfig
 	stopCh      chan struct{}
 	clientConns map[string]*net.TCPConn
 	logger      *log.Logger
 	listener    net.Listener
+	credentials CredentialStore
+	authHandler map[socks5.Socks5Method]AuthHandler
+	httpProxy   *httpProxy
+	// 不为空时为本地 socks5 服务, 见 NewLocalSocksServer
+	remote *Dialer
+	// remote 由 NewLocalSocksServer 创建, Stop 时关闭; 共享的 Dialer 由调用方关闭
+	ownRemote bool
+}
+
+// serverSession 一个客户端连接的状态, 认证通过后记录用户名
+type serverSession struct {
+	conn     net.Conn
+	method   socks5.Socks5Method
+	username string
+	// 多路复用会话上的流, 只支持 CONNECT
+	muxed bool
 }
 
 func NewServer(config *ServerConfig) *server {
-	return &server{
+	credentials := config.Credentials
+	if credentials == nil {
+		credentials = &staticCredentials{user: config.User, password: config.Password}
+	}
+
+	s := &server{
 		config:      config,
 		stopCh:      make(chan struct{}),
 		clientConns: make(map[string]*net.TCPConn),
 		logger:      log.New(os.Stdout, "", log.LstdFlags),
+		credentials: credentials,
+		authHandler: make(map[socks5.Socks5Method]AuthHandler),
 	}
+
+	s.RegisterAuthMethod(socks5.Socks5MethodNoAuth, func(conn net.Conn) (string, error) {
+		return "", nil
+	})
+	s.RegisterAuthMethod(socks5.Socks5MethodUserPass, s.authUserPassword)
+	s.httpProxy = s.newServerHttpProxy()
+
+	return s
+}
+
+// RegisterAuthMethod 注册认证方式, 需在 Serve 之前调用
+func (s *server) RegisterAuthMethod(method socks5.Socks5Method, handler AuthHandler) {
+	s.authHandler[method] = handler
 }
 
 func (s *server) Serve() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Addr, s.config.Port)
+	addr := net.JoinHostPort(s.config.Addr, strconv.Itoa(s.config.Port))
 	s.logger.Printf("socks5 server listen on %s", addr)
-	s.logger.Printf("auth method: %d", s.config.AuthMethod)
-	s.logger.Printf("auth user: %s, passwd: %s", s.config.User, s.config.Password)
+	s.logger.Printf("auth methods: %v", s.authMethods(nil))
+	for _, p := range s.config.AuthPolicies {
+		s.logger.Printf("auth methods for %s: %v", p.Network, p.Methods)
+	}
+	if s.config.HttpProxy {
+		s.logger.Printf("http proxy enabled on the same port")
+	}
+	if s.config.Mux {
+		s.logger.Printf("mux sessions enabled")
+	}
+	if s.config.Credentials == nil {
+		s.logger.Printf("auth user: %s, passwd: %s", s.config.User, s.config.Password)
+	}
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	if s.config.TLSConfig != nil {
+		l = tls.NewListener(l, s.config.TLSConfig)
+		s.logger.Printf("tls enabled, client cert required: %v", s.config.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+	}
 	s.logger.Printf("server running, waiting for client")
 	s.listener = l
 
@@ -80,32 +173,68 @@ func (s *server) Serve() error {
 					}
 				}()
 
-				method, err := s.handshake(conn)
-				if err != nil {
-					s.logger.Printf("handshake error: %v", err)
-					_ = conn.Close()
-					return
-				}
-
-				if method == socks5.Socks5MethodUserPass {
-					if err := s.authUserPassword(conn); err != nil {
-						s.logger.Printf("auth error: %v", err)
-						return
-					}
-				}
-
-				if err := s.cmdExec(conn); err != nil {
-					s.logger.Printf("cmd exec error: %v", err)
-					return
-				}
+				s.serveConn(conn)
 			}()
 		}
 	}
+}
 
-	return nil
+// serveConn 按首字节分发: 0x04 为 socks4, 0x05 为 socks5, 开启 http 代理时大写字母开头为 http 请求
+func (s *server) serveConn(c net.Conn) {
+	conn := newBufferedConn(c)
+	ver, err := conn.Peek(1)
+	if err != nil {
+		s.logger.Printf("read version error: %v", err)
+		_ = conn.Close()
+		return
+	}
+
+	switch ver[0] {
+	case socks4Version:
+		if err := s.serveSocks4(conn); err != nil {
+			s.logger.Printf("socks4 error: %v", err)
+		}
+	case byte(socks5.Socks5Version5):
+		s.serveSocks5(conn)
+	default:
+		if s.config.HttpProxy && isHttpMethodByte(ver[0]) {
+			s.serveHttp(conn)
+			return
+		}
+
+		s.logger.Printf("socks version not support: %d", ver[0])
+		_ = conn.Close()
+	}
 }
 
-func (s *server) handshake(conn net.Conn) (socks5.Socks5Method, error) {
+func (s *server) serveSocks5(conn net.Conn) {
+	certUser := tlsUsername(conn)
+	method, err := s.handshake(conn, certUser != "")
+	if err != nil {
+		s.logger.Printf("handshake error: %v", err)
+		_ = conn.Close()
+		return
+	}
+
+	username, err := s.authHandler[method](conn)
+	if err != nil {
+		s.logger.Printf("auth error: %v", err)
+		_ = conn.Close()
+		return
+	}
+	if method == socks5.Socks5MethodNoAuth && certUser != "" {
+		username = certUser
+	}
+	sess := &serverSession{conn: conn, method: method, username: username}
+
+	if err := s.cmdExec(sess); err != nil {
+		s.logger.Printf("cmd exec error: %v", err)
+		return
+	}
+}
+
+// handshake 协商认证方式, certAuthed 为客户端证书已通过校验, 客户端支持时选择 NoAuth
+func (s *server) handshake(conn net.Conn, certAuthed bool) (socks5.Socks5Method, error) {
 	req := &socks5.HandshakeReq{}
 	if err := req.ReadIO(conn); err != nil {
 		return 0, err
@@ -115,68 +244,139 @@ func (s *server) handshake(conn net.Conn) (socks5.Socks5Method, error) {
 		_ = conn.Close()
 		return 0, errors.New("socks version not support")
 	}
-	if req.NMethods == 0 {
-		_ = conn.Close()
-		return 0, errors.New("no auth method")
-	}
-
-	var support bool
-	for _, m := range req.Methods {
-		if m == s.config.AuthMethod {
-			support = true
-			break
+	method := s.selectMethod(conn.RemoteAddr(), req.Methods)
+	if certAuthed {
+		for _, m := range req.Methods {
+			if m == socks5.Socks5MethodNoAuth {
+				method = m
+			}
 		}
 	}
 
-	if !support {
-		_ = conn.Close()
-		return 0, errors.New("auth method not support")
-	}
 	rsp := &socks5.HandshakeResp{}
 	rsp.Ver = socks5.Socks5Version5
-	rsp.Method = s.config.AuthMethod
+	rsp.Method = method
 
 	if err := rsp.WriteIO(conn); err != nil {
 		_ = conn.Close()
 		return 0, err
 	}
 
-	s.logger.Printf("handshake success, auth method: %d", s.config.AuthMethod)
+	if method == socks5.Socks5MethodNoAcceptable {
+		_ = conn.Close()
+		return 0, fmt.Errorf("no acceptable auth method in %v", req.Methods)
+	}
+
+	s.logger.Printf("handshake success, auth method: %d", method)
+
+	return method, nil
+}
+
+// authMethods 返回来源地址可用的认证方式, 按优先级排列
+func (s *server) authMethods(addr net.Addr) []socks5.Socks5Method {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		for _, p := range s.config.AuthPolicies {
+			if p.Network != nil && p.Network.Contains(tcpAddr.IP) {
+				return p.Methods
+			}
+		}
+	}
+
+	if len(s.config.AuthMethods) > 0 {
+		return s.config.AuthMethods
+	}
+	return []socks5.Socks5Method{s.config.AuthMethod}
+}
+
+// pickMethod 按来源地址可用的认证方式的优先级, 返回第一个已启用且 usable 的方式, 没有时返回 0xFF
+func (s *server) pickMethod(addr net.Addr, usable func(m socks5.Socks5Method) bool) socks5.Socks5Method {
+	for _, m := range s.authMethods(addr) {
+		if _, ok := s.authHandler[m]; ok && usable(m) {
+			return m
+		}
+	}
 
-	return s.config.AuthMethod, nil
+	return socks5.Socks5MethodNoAcceptable
 }
 
-func (s *server) authUserPassword(conn net.Conn) error {
+// selectMethod 按服务端的优先级选择客户端也支持的认证方式, 没有时返回 0xFF
+func (s *server) selectMethod(addr net.Addr, offered []socks5.Socks5Method) socks5.Socks5Method {
+	return s.pickMethod(addr, func(m socks5.Socks5Method) bool {
+		for _, o := range offered {
+			if o == m {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// authPassword 没有单独认证协商的协议 (socks4, http) 的认证: 客户端证书通过校验时用户名为证书的 CommonName;
+// 否则按来源地址可用的认证方式, 选择无认证时不校验也不使用客户端提供的用户名, 返回空用户名;
+// 提供了用户名密码 (hasPassword) 时可以选择用户名密码认证, 校验通过后用户名为 user
+func (s *server) authPassword(conn net.Conn, user, password string, hasPassword bool) (string, bool) {
+	if certUser := tlsUsername(conn); certUser != "" {
+		return certUser, true
+	}
+
+	method := s.pickMethod(conn.RemoteAddr(), func(m socks5.Socks5Method) bool {
+		return m == socks5.Socks5MethodNoAuth || (m == socks5.Socks5MethodUserPass && hasPassword)
+	})
+
+	switch method {
+	case socks5.Socks5MethodNoAuth:
+		return "", true
+	case socks5.Socks5MethodUserPass:
+		ok, err := s.credentials.Verify(user, password)
+		if err != nil {
+			s.logger.Printf("verify user %s error: %v", user, err)
+		}
+		return user, ok
+	}
+	return "", false
+}
+
+func (s *server) authUserPassword(conn net.Conn) (string, error) {
 	req := &socks5.AuthUserPasswordReq{}
 	if err := req.ReadIO(conn); err != nil {
-		return err
+		return "", err
 	}
 
 	rsp := &socks5.AuthUserPasswordResp{}
 	rsp.Ver = 0x01
 
-	if s.config.User != req.Uname || s.config.Password != req.Passwd {
+	ok, err := s.credentials.Verify(req.Uname, req.Passwd)
+	if err != nil {
+		s.logger.Printf("verify user %s error: %v", req.Uname, err)
+	}
+
+	if !ok {
 		rsp.Status = 0xFF
 		if err := rsp.WriteIO(conn); err != nil {
-			return err
+			return "", err
 		}
 		_ = conn.Close()
-		return errors.New("username or password error")
+		return "", errors.New("username or password error")
 	}
 
 	rsp.Status = 0
 	if err := rsp.WriteIO(conn); err != nil {
 		_ = conn.Close()
-		return err
+		return "", err
 	}
 
-	s.logger.Printf("auth success, username: %s", s.config.User)
-	return nil
+	s.logger.Printf("auth success, username: %s", req.Uname)
+	return req.Uname, nil
 }
 
-func (s *server) cmdExec(conn net.Conn) error {
-	req := &socks5.Socks5CmdRequest{}
-	if err := req.ReadIO(conn); err != nil {
+func (s *server) cmdExec(sess *serverSession) error {
+	conn := sess.conn
+	req, err := readCmdRequest(conn)
+	if err != nil {
+		if errors.Is(err, errAddrTypeNotSupported) {
+			_ = writeCmdResponse(conn, socks5.Socks5RepAddressTypeNotSupported, nil)
+			_ = conn.Close()
+		}
 		return err
 	}
 
@@ -185,39 +385,139 @@ func (s *server) cmdExec(conn net.Conn) error {
 		return errors.New("socks version not support")
 	}
 
+	if req.Cmd == socks5CmdMux {
+		return s.serveMux(sess)
+	}
+	if sess.muxed && req.Cmd != socks5.Socks5CmdConnect {
+		_ = writeCmdResponse(conn, socks5.Socks5RepCommandNotSupported, nil)
+		_ = conn.Close()
+		return fmt.Errorf("%s not supported on mux stream", cmdName(req.Cmd))
+	}
+
+	aclReq := s.newACLRequest(sess, req)
+	ips, err := s.checkACL(aclReq)
+	if err != nil {
+		s.logger.Printf("acl: %s, user: %s, cmd: %d, dst: %s, error: %v", conn.RemoteAddr().String(), sess.username, req.Cmd, socks5HostPort(req.Addr), err)
+		_ = writeCmdResponse(conn, dialErrorRep(err), nil)
+		_ = conn.Close()
+		return err
+	}
+
+	reply := func(rep socks5.Socks5Rep, bound net.Addr) error {
+		return writeCmdResponse(conn, rep, bound)
+	}
+
 	switch req.Cmd {
 	case socks5.Socks5CmdConnect:
-		cmd := &serverCmdConnect{
-			cliConn: conn,
-			cmd:     req,
-			stopCh:  s.stopCh,
+		return s.serveConnect("socks5", sess, req, aclReq, ips, reply)
+
+	case socks5.Socks5CmdBind:
+		return s.serveBind("socks5", sess, req, reply)
+
+	case socks5.Socks5CmdUdpAssociate:
+		cmd := &serverCmdUdpAssociate{
+			cliConn:  conn,
+			cmd:      req,
+			stopCh:   s.stopCh,
+			acl:      s.config.ACL,
+			username: sess.username,
+			remote:   s.remote,
 		}
 
-		if err := cmd.connectRemote(); err != nil {
-			s.logger.Printf("connect remote error: %v", err)
-			if err := cmd.response(socks5.Socks5RepHostUnreachable); err != nil {
-				cmd.close()
-			}
+		if err := cmd.listen(); err != nil {
+			s.logger.Printf("udp associate listen error: %v", err)
+			_ = cmd.response(socks5.Socks5RepGeneralFailure)
 			_ = conn.Close()
 			return err
 		}
 
 		if err := cmd.response(socks5.Socks5RepSuccess); err != nil {
 			cmd.close()
+			return err
 		}
 
+		s.logger.Printf("udp associate: %s, user: %s, relay: %s", conn.RemoteAddr().String(), sess.username, cmd.relayConn.LocalAddr().String())
 		cmd.run()
 
-	case socks5.Socks5CmdBind:
-		// bind
-	case socks5.Socks5CmdUdpAssociate:
-		// udp associate
+	default:
+		_ = writeCmdResponse(conn, socks5.Socks5RepCommandNotSupported, nil)
+		_ = conn.Close()
+		return fmt.Errorf("command not supported: %d", req.Cmd)
 	}
 	return nil
 }
 
+// newACLRequest 构造规则匹配用的请求;
+// bind/udp 请求中的地址不是访问目标, 只按命令/用户/来源匹配, udp 的目标在转发时逐个校验
+func (s *server) newACLRequest(sess *serverSession, req *socks5.Socks5CmdRequest) *aclRequest {
+	aclReq := &aclRequest{
+		cmd:      req.Cmd,
+		username: sess.username,
+		port:     req.Addr.Port,
+	}
+	if tcpAddr, ok := sess.conn.RemoteAddr().(*net.TCPAddr); ok {
+		aclReq.source = tcpAddr.IP
+	}
+
+	if req.Cmd == socks5.Socks5CmdConnect {
+		if req.Atyp == socks5.Socks5AddrTypeDomainName {
+			aclReq.host = req.Addr.Addr
+		} else {
+			aclReq.ips = []net.IP{net.ParseIP(req.Addr.Addr)}
+		}
+	}
+
+	return aclReq
+}
+
+// checkACL 校验访问规则, 目标为域名且规则需要时解析域名, 返回解析结果供连接时使用
+func (s *server) checkACL(aclReq *aclRequest) ([]net.IP, error) {
+	acl := s.config.ACL
+	if acl == nil {
+		return nil, nil
+	}
+
+	if aclReq.host != "" && acl.needResolve() {
+		ips, err := lookupIP(aclReq.host)
+		if err != nil {
+			// 解析失败时仍按域名规则判断, 被拒绝的域名返回 not allowed
+			if !acl.allow(aclReq) {
+				return nil, errConnectionNotAllowed
+			}
+			return nil, err
+		}
+		aclReq.ips = ips
+	}
+
+	if !acl.allow(aclReq) {
+		return nil, errConnectionNotAllowed
+	}
+	return aclReq.ips, nil
+}
+
 func (s *server) Stop() error {
 	close(s.stopCh)
 	_ = s.listener.Close()
+	if s.remote != nil && s.ownRemote {
+		_ = s.remote.Close()
+	}
 	return nil
 }
+
+// bufferedConn 预读首字节判断协议版本, 预读的数据仍可通过 Read 读到
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,290 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+const defaultBindTimeout = 60 * time.Second
+
+// 等待入站连接期间最多缓存的客户端数据, 超过后不再读取控制连接
+const bindEarlyMaxSize = 64 * 1024
+
+var errBindClientClosed = errors.New("client closed control connection")
+
+// 很早以前的时间, 用作读超时来中断阻塞的 Read
+var aLongTimeAgo = time.Unix(1, 0)
+
+type serverCmdBind struct {
+	cliConn    net.Conn
+	cmd        *socks5.Socks5CmdRequest
+	listener   *net.TCPListener
+	remoteConn net.Conn
+	stopCh     chan struct{}
+
+	timeout   time.Duration
+	portStart int
+	portEnd   int
+
+	// 等待入站连接期间客户端在控制连接上发送的数据, 转发时先发给对端
+	early []byte
+}
+
+// serveBind 监听并等待对端连入, 两次通过 reply 应答客户端 (监听地址和对端地址) 后转发数据
+func (s *server) serveBind(proto string, sess *serverSession, req *socks5.Socks5CmdRequest, reply cmdReply) error {
+	conn := sess.conn
+	if s.remote != nil {
+		_ = reply(socks5.Socks5RepCommandNotSupported, nil)
+		_ = conn.Close()
+		return errors.New("bind not supported by local socks server")
+	}
+
+	cmd := &serverCmdBind{
+		cliConn:   conn,
+		cmd:       req,
+		stopCh:    s.stopCh,
+		timeout:   s.config.BindTimeout,
+		portStart: s.config.BindPortStart,
+		portEnd:   s.config.BindPortEnd,
+	}
+
+	if err := cmd.listen(); err != nil {
+		s.logger.Printf("%s bind listen error: %v", proto, err)
+		_ = reply(socks5.Socks5RepGeneralFailure, nil)
+		_ = conn.Close()
+		return err
+	}
+
+	// 第一次应答, 告知客户端监听地址
+	if err := reply(socks5.Socks5RepSuccess, cmd.listener.Addr()); err != nil {
+		cmd.close()
+		return err
+	}
+	s.logger.Printf("%s bind: %s, user: %s, listen: %s", proto, conn.RemoteAddr().String(), sess.username, cmd.listener.Addr().String())
+
+	if err := cmd.accept(); err != nil {
+		s.logger.Printf("%s bind accept error: %v", proto, err)
+		_ = reply(acceptErrorRep(err), nil)
+		cmd.close()
+		return err
+	}
+
+	// 第二次应答, 告知客户端对端地址
+	if err := reply(socks5.Socks5RepSuccess, cmd.remoteConn.RemoteAddr()); err != nil {
+		cmd.close()
+		return err
+	}
+	s.logger.Printf("%s bind: %s, accepted: %s", proto, conn.RemoteAddr().String(), cmd.remoteConn.RemoteAddr().String())
+
+	cmd.run()
+	return nil
+}
+
+// listen 在控制连接所在的本地地址上监听, 配置了端口范围时从范围内挑选可用端口
+func (s *serverCmdBind) listen() error {
+	laddr := &net.TCPAddr{}
+	if tcpAddr, ok := s.cliConn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = tcpAddr.IP
+	}
+
+	if s.portStart <= 0 || s.portEnd < s.portStart {
+		l, err := net.ListenTCP("tcp", laddr)
+		if err != nil {
+			return err
+		}
+		s.listener = l
+		return nil
+	}
+
+	n := s.portEnd - s.portStart + 1
+	offset := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		laddr.Port = s.portStart + (offset+i)%n
+		l, err := net.ListenTCP("tcp", laddr)
+		if err != nil {
+			continue
+		}
+		s.listener = l
+		return nil
+	}
+
+	return fmt.Errorf("no free port in range %d-%d", s.portStart, s.portEnd)
+}
+
+// accept 等待一个入站连接, 请求中带了 DST.ADDR 时只接受来自该地址的连接
+func (s *serverCmdBind) accept() error {
+	timeout := s.timeout
+	if timeout <= 0 {
+		timeout = defaultBindTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	_ = s.listener.SetDeadline(deadline)
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-s.stopCh:
+			_ = s.listener.Close()
+		case <-doneCh:
+		}
+	}()
+
+	allowed, err := s.allowedIPs(deadline)
+	if err != nil {
+		return err
+	}
+
+	goneCh, stopWatch := s.watchClient()
+	defer stopWatch()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-goneCh:
+				return errBindClientClosed
+			default:
+			}
+			return err
+		}
+
+		if s.isAllowed(allowed, conn.RemoteAddr()) {
+			s.remoteConn = conn
+			// 只接受一个连接
+			_ = s.listener.Close()
+			return nil
+		}
+
+		_ = conn.Close()
+	}
+}
+
+// watchClient 等待入站连接期间持续读取控制连接, 数据保存在 early 中 (最多 bindEarlyMaxSize);
+// 读到 EOF 或出错说明客户端已断开, 关闭 goneCh 和监听; stop 中断读取
+func (s *serverCmdBind) watchClient() (goneCh <-chan struct{}, stop func()) {
+	gone := make(chan struct{})
+	stopCh := make(chan struct{})
+	exitCh := make(chan struct{})
+
+	go func() {
+		defer close(exitCh)
+
+		buf := make([]byte, 4096)
+		for len(s.early) < bindEarlyMaxSize {
+			n, err := s.cliConn.Read(buf[:min(len(buf), bindEarlyMaxSize-len(s.early))])
+			s.early = append(s.early, buf[:n]...)
+			if err == nil {
+				continue
+			}
+
+			select {
+			case <-stopCh:
+			default:
+				close(gone)
+				_ = s.listener.Close()
+			}
+			return
+		}
+	}()
+
+	return gone, func() {
+		close(stopCh)
+		_ = s.cliConn.SetReadDeadline(aLongTimeAgo)
+		<-exitCh
+		_ = s.cliConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// allowedIPs 解析请求中声明的对端地址, 全零地址表示不限制; 域名解析不超过 deadline
+func (s *serverCmdBind) allowedIPs(deadline time.Time) ([]net.IP, error) {
+	if s.cmd.Atyp == socks5.Socks5AddrTypeDomainName {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, s.cmd.Addr.Addr)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+		return ips, nil
+	}
+
+	ip := net.ParseIP(s.cmd.Addr.Addr)
+	if ip == nil {
+		return nil, errors.New("invalid bind address: " + s.cmd.Addr.Addr)
+	}
+	if ip.IsUnspecified() {
+		return nil, nil
+	}
+
+	return []net.IP{ip}, nil
+}
+
+func (s *serverCmdBind) isAllowed(allowed []net.IP, addr net.Addr) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ip := range allowed {
+		if ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serverCmdBind) close() {
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+
+	if s.cliConn != nil {
+		_ = s.cliConn.Close()
+	}
+
+	if s.remoteConn != nil {
+		_ = s.remoteConn.Close()
+	}
+}
+
+// acceptErrorRep 把等待入站连接的错误映射为应答码, 超时返回 TTL expired
+func acceptErrorRep(err error) socks5.Socks5Rep {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5.Socks5RepTTLExpired
+	}
+	return socks5.Socks5RepGeneralFailure
+}
+
+// run 与 connect 一样转发数据, 先把等待期间客户端发送的数据发给对端
+func (s *serverCmdBind) run() {
+	if len(s.early) > 0 {
+		if _, err := s.remoteConn.Write(s.early); err != nil {
+			s.close()
+			return
+		}
+	}
+
+	cmd := &serverCmdConnect{
+		cliConn:    s.cliConn,
+		cmd:        s.cmd,
+		remoteConn: s.remoteConn,
+		stopCh:     s.stopCh,
+	}
+	cmd.run()
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// bindRequest 发送 BIND 请求并读取第一次应答, 返回控制连接和监听地址
+func bindRequest(t *testing.T, addr, peer string) (net.Conn, string) {
+	t.Helper()
+
+	conn, _ := dialSocks5(t, addr)
+	resp := socks5Request(t, conn, socks5.Socks5CmdBind, peer)
+	if resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("first reply: %d", resp.Rep)
+	}
+	return conn, socks5HostPort(resp.Addr)
+}
+
+func TestServerBind(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	conn, listen := bindRequest(t, addr, "0.0.0.0:0")
+	defer conn.Close()
+
+	peer, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	resp := readSocks5Reply(t, conn)
+	if resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("second reply: %d", resp.Rep)
+	}
+	if got := socks5HostPort(resp.Addr); got != peer.LocalAddr().String() {
+		t.Fatalf("second reply addr: %s, want %s", got, peer.LocalAddr())
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("bind data: %q, %v", got, err)
+	}
+}
+
+// 第一次应答后控制连接断开时关闭监听, 不等到超时
+func TestServerBindClientClosed(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, BindTimeout: time.Minute})
+
+	// 只接受来自 192.0.2.1 的连接, 检查用的连接会被拒绝而不是结束 BIND
+	conn, listen := bindRequest(t, addr, "192.0.2.1:0")
+	_ = conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		peer, err := net.Dial("tcp", listen)
+		if err != nil {
+			return
+		}
+		_ = peer.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("bind listener still open after client closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 等待入站连接期间客户端分多次发送的数据都转发给对端
+func TestServerBindEarlyData(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	conn, listen := bindRequest(t, addr, "0.0.0.0:0")
+	defer conn.Close()
+
+	for _, s := range []string{"hello", " ", "world"} {
+		if _, err := conn.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	peer, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if resp := readSocks5Reply(t, conn); resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("second reply: %d", resp.Rep)
+	}
+	got := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "hello world" {
+		t.Fatalf("early data: %q, %v", got, err)
+	}
+}
+
+// 超时没有对端连入时第二次应答为 TTL expired
+func TestServerBindTimeout(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, BindTimeout: 100 * time.Millisecond})
+
+	conn, _ := bindRequest(t, addr, "0.0.0.0:0")
+	defer conn.Close()
+
+	if resp := readSocks5Reply(t, conn); resp.Rep != socks5.Socks5RepTTLExpired {
+		t.Fatalf("second reply: %d, want %d", resp.Rep, socks5.Socks5RepTTLExpired)
+	}
+}
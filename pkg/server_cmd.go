@@ -1,10 +1,14 @@
 package pkg
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	socks5 "github.com/ojbkgo/socks5-protocol"
@@ -15,48 +19,152 @@ type serverCmdConnect struct {
 	cmd        *socks5.Socks5CmdRequest
 	remoteConn net.Conn
 	stopCh     chan struct{}
+	// 访问规则检查时解析出的目标地址, 连接时直接使用, 避免再次解析得到不同的地址
+	dstIPs []net.IP
+	// 上游代理链, 为空时直连
+	chain []*Upstream
+	// 本地 socks5 服务通过远端 socks5 服务端连接目标, 不为空时不使用 chain
+	remote *Dialer
 }
 
-func (s *serverCmdConnect) response(rep socks5.Socks5Rep) error {
-	resp := &socks5.Socks5CmdResponse{
-		Ver:  socks5.Socks5Version5,
-		Rep:  rep,
-		Rsv:  0,
-		Atyp: s.cmd.Atyp,
+// cmdReply 按 socks5 的应答码应答客户端, socks4 在回调中转换; bound 为应答中的地址
+type cmdReply func(rep socks5.Socks5Rep, bound net.Addr) error
+
+// connectTarget 按访问规则检查的结果选择上游代理并连接目标, socks5/socks4 的 CONNECT 和 http 代理共用
+func (s *server) connectTarget(proto string, sess *serverSession, req *socks5.Socks5CmdRequest, aclReq *aclRequest, ips []net.IP) (*serverCmdConnect, error) {
+	cmd := &serverCmdConnect{
+		cliConn: sess.conn,
+		cmd:     req,
+		stopCh:  s.stopCh,
+		dstIPs:  ips,
+		remote:  s.remote,
+	}
+	if s.config.Upstreams != nil && s.remote == nil {
+		cmd.chain = s.config.Upstreams.route(aclReq)
 	}
 
-	_, err := s.cliConn.Write(resp.Serialize())
-	return err
+	if err := cmd.connectRemote(); err != nil {
+		s.logger.Printf("%s connect remote error: %v", proto, err)
+		return nil, err
+	}
+
+	s.logger.Printf("%s connect: %s, user: %s, remote: %s, via: %s", proto, sess.conn.RemoteAddr().String(), sess.username, socks5HostPort(req.Addr), cmd.via())
+	return cmd, nil
+}
+
+// serveConnect 连接目标, 通过 reply 应答客户端后转发数据
+func (s *server) serveConnect(proto string, sess *serverSession, req *socks5.Socks5CmdRequest, aclReq *aclRequest, ips []net.IP, reply cmdReply) error {
+	cmd, err := s.connectTarget(proto, sess, req, aclReq, ips)
+	if err != nil {
+		_ = reply(dialErrorRep(err), nil)
+		_ = sess.conn.Close()
+		return err
+	}
+
+	// BND.ADDR/BND.PORT 为连接目标时使用的本地地址
+	if err := reply(socks5.Socks5RepSuccess, cmd.remoteConn.LocalAddr()); err != nil {
+		cmd.close()
+		return err
+	}
+
+	cmd.run()
+	return nil
+}
+
+// dialErrorRep 把连接目标的错误映射为 RFC 1928 的应答码, 无法识别的错误返回 general failure
+func dialErrorRep(err error) socks5.Socks5Rep {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var replyErr *ReplyError
+
+	switch {
+	case errors.As(err, &replyErr):
+		// 远端或上游 socks5 服务端的应答原样返回
+		return replyErr.Rep
+	case errors.Is(err, errAddrTypeNotSupported):
+		return socks5.Socks5RepAddressTypeNotSupported
+	case errors.Is(err, errConnectionNotAllowed):
+		return socks5.Socks5RepConnectionNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.Socks5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5.Socks5RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5.Socks5RepHostUnreachable
+	case errors.As(err, &dnsErr):
+		// 域名解析失败 (包括解析超时) 说明目标主机不可达
+		return socks5.Socks5RepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5.Socks5RepTTLExpired
+	}
+
+	return socks5.Socks5RepGeneralFailure
 }
 
 func (s *serverCmdConnect) connectRemote() error {
-	switch s.cmd.Atyp {
-	case socks5.Socks5AddrTypeIPv4:
-		remoteConn, err := net.DialTimeout(
-			"tcp",
-			fmt.Sprintf("%s:%d", s.cmd.Addr.Addr, s.cmd.Addr.Port),
-			time.Second)
+	if !socks5.IsAllowedAddrType(s.cmd.Atyp) {
+		return errAddrTypeNotSupported
+	}
 
+	if s.remote != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		defer cancel()
+
+		remoteConn, err := s.remote.DialContext(ctx, "tcp", socks5HostPort(s.cmd.Addr))
 		if err != nil {
 			return err
 		}
 
 		s.remoteConn = remoteConn
-	case socks5.Socks5AddrTypeIPv6:
-		// unsupported
-	case socks5.Socks5AddrTypeDomainName:
-		remoteConn, err := net.DialTimeout(
-			"tcp",
-			fmt.Sprintf("%s:%d", s.cmd.Addr.Addr, s.cmd.Addr.Port),
-			time.Second)
+		return nil
+	}
+
+	if len(s.chain) > 0 {
+		remoteConn, err := dialChain(s.chain, s.cmd.Addr.Addr, int(s.cmd.Addr.Port))
 		if err != nil {
 			return err
 		}
 
 		s.remoteConn = remoteConn
+		return nil
 	}
 
-	return nil
+	// JoinHostPort 会给 ipv6 地址加上方括号, 域名由 Dial 同时尝试 ipv4/ipv6
+	addrs := []string{socks5HostPort(s.cmd.Addr)}
+	if len(s.dstIPs) > 0 {
+		addrs = addrs[:0]
+		for _, ip := range s.dstIPs {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(s.cmd.Addr.Port))))
+		}
+	}
+
+	var err error
+	for _, addr := range addrs {
+		var remoteConn net.Conn
+		remoteConn, err = net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			s.remoteConn = remoteConn
+			return nil
+		}
+	}
+	return err
+}
+
+// via 用于日志, 返回经过的上游代理
+func (s *serverCmdConnect) via() string {
+	if s.remote != nil {
+		return "socks5://" + s.remoteConn.RemoteAddr().String()
+	}
+
+	if len(s.chain) == 0 {
+		return "direct"
+	}
+
+	via := make([]string, 0, len(s.chain))
+	for _, up := range s.chain {
+		via = append(via, up.Type+"://"+up.Addr)
+	}
+	return strings.Join(via, " -> ")
 }
 
 func (s *serverCmdConnect) close() {
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// echoRoundTrip 通过 conn 发送 data 并读取同样长度的回显
+func echoRoundTrip(t *testing.T, conn net.Conn, data string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != data {
+		t.Fatalf("echo: %q, %v", got, err)
+	}
+}
+
+func TestServerConnectIPv6(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startEchoServerOn(t, "[::1]:0")
+
+	conn, _ := dialSocks5(t, addr)
+	defer conn.Close()
+
+	resp := socks5Request(t, conn, socks5.Socks5CmdConnect, echo)
+	if resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("connect reply: %d", resp.Rep)
+	}
+	echoRoundTrip(t, conn, "ping6")
+}
+
+func TestClientConnectIPv6(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{
+		AuthMethod: socks5.Socks5MethodUserPass,
+		User:       "user",
+		Password:   "pass",
+	})
+	echo := startEchoServerOn(t, "[::1]:0")
+
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	c := NewClient(&ClientConfig{RemoteAddr: host, RemotePort: p, Username: "user", Password: "pass"})
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, echoPort, _ := net.SplitHostPort(echo)
+	ep, _ := strconv.Atoi(echoPort)
+	if err := c.ConnectIPV6("::1", ep); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echoRoundTrip(t, c.conn, "ping6")
+}
+
+// 不认识的 ATYP 应答 address type not supported
+func TestServerConnectAddrTypeNotSupported(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	conn, _ := dialSocks5(t, addr)
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{byte(socks5.Socks5Version5), byte(socks5.Socks5CmdConnect), 0, 0x05}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := readSocks5Reply(t, conn); resp.Rep != socks5.Socks5RepAddressTypeNotSupported {
+		t.Fatalf("connect reply: %d, want %d", resp.Rep, socks5.Socks5RepAddressTypeNotSupported)
+	}
+}
+
+// 成功应答的 BND.ADDR/BND.PORT 为服务端连接目标使用的本地地址
+func TestServerConnectBoundAddr(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, _ := dialSocks5(t, addr)
+	defer conn.Close()
+
+	resp := socks5Request(t, conn, socks5.Socks5CmdConnect, l.Addr().String())
+	if resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("connect reply: %d", resp.Rep)
+	}
+
+	target, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if got := socks5HostPort(resp.Addr); got != target.RemoteAddr().String() {
+		t.Fatalf("bound addr: %s, want %s", got, target.RemoteAddr())
+	}
+}
+
+func TestServerConnectRefused(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	_ = l.Close()
+
+	conn, _ := dialSocks5(t, addr)
+	defer conn.Close()
+
+	if resp := socks5Request(t, conn, socks5.Socks5CmdConnect, closed); resp.Rep != socks5.Socks5RepConnectionRefused {
+		t.Fatalf("connect reply: %d, want %d", resp.Rep, socks5.Socks5RepConnectionRefused)
+	}
+}
+
+func TestDialErrorRep(t *testing.T) {
+	syscallErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want socks5.Socks5Rep
+	}{
+		{"addr type", errAddrTypeNotSupported, socks5.Socks5RepAddressTypeNotSupported},
+		{"refused", syscallErr(syscall.ECONNREFUSED), socks5.Socks5RepConnectionRefused},
+		{"net unreachable", syscallErr(syscall.ENETUNREACH), socks5.Socks5RepNetworkUnreachable},
+		{"host unreachable", syscallErr(syscall.EHOSTUNREACH), socks5.Socks5RepHostUnreachable},
+		{"no such host", &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, socks5.Socks5RepHostUnreachable},
+		{"dns timeout", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", Name: "x.invalid", IsTimeout: true}}, socks5.Socks5RepHostUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, socks5.Socks5RepTTLExpired},
+		{"context deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), socks5.Socks5RepTTLExpired},
+		{"unknown", errors.New("something went wrong"), socks5.Socks5RepGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		if got := dialErrorRep(tt.err); got != tt.want {
+			t.Errorf("%s: dialErrorRep(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
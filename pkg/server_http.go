@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"net"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// isHttpMethodByte 判断首字节是否可能是 http 请求方法, 方法名为大写字母
+func isHttpMethodByte(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// serveHttp 同一端口上的 http 代理, 与 socks 共用认证方式, 访问规则和上游代理
+func (s *server) serveHttp(conn net.Conn) {
+	s.httpProxy.serveConn(conn)
+}
+
+// newServerHttpProxy 所有 http 连接共用一个 httpProxy; 访问规则和上游路由与来源地址有关,
+// 空闲隧道只在同一客户端连接内复用, 不能跨连接共享
+func (s *server) newServerHttpProxy() *httpProxy {
+	return &httpProxy{
+		stopCh: s.stopCh,
+		config: &HttpProxyConfig{},
+		dial:   s.dialHttp,
+		auth:   s.authHttp,
+	}
+}
+
+// authHttp 按来源地址可用的认证方式校验 Proxy-Authorization, 返回认证后的用户名:
+// 允许无认证时直接通过, 允许用户名密码认证时校验 Basic 认证的用户名密码;
+// 客户端证书通过校验时用户名为证书的 CommonName
+func (s *server) authHttp(conn net.Conn, proxyAuth string) (httpUser, error) {
+	user, password, hasAuth := parseBasicAuth(proxyAuth)
+	if username, ok := s.authPassword(conn, user, password, hasAuth); ok {
+		return httpUser{name: username}, nil
+	}
+	return httpUser{}, errHttpAuthFailed
+}
+
+// dialHttp 按 socks5 CONNECT 的流程校验访问规则, 选择上游代理并连接目标
+func (s *server) dialHttp(conn net.Conn, user httpUser, host string, port int) (net.Conn, error) {
+	req := &socks5.Socks5CmdRequest{
+		Ver:  socks5.Socks5Version5,
+		Cmd:  socks5.Socks5CmdConnect,
+		Atyp: socks5AddrTypeOf(host),
+		Addr: socks5.Socks5Addr{Addr: host, Port: uint16(port)},
+	}
+	sess := &serverSession{conn: conn, username: user.name}
+
+	aclReq := s.newACLRequest(sess, req)
+	ips, err := s.checkACL(aclReq)
+	if err != nil {
+		s.logger.Printf("acl: %s, user: %s, http, dst: %s, error: %v", conn.RemoteAddr().String(), user.name, socks5HostPort(req.Addr), err)
+		return nil, err
+	}
+
+	cmd, err := s.connectTarget("http", sess, req, aclReq, ips)
+	if err != nil {
+		return nil, err
+	}
+	return cmd.remoteConn, nil
+}
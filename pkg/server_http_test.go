@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// httpConnect 通过 http 代理 addr 发送 CONNECT target, 返回连接, 读取应答的 reader 和状态码;
+// auth 不为空时作为 Proxy-Authorization 的 Basic 认证 "user:password"
+func httpConnect(t *testing.T, addr, target, auth string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if auth != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code int
+	if _, err := fmt.Sscanf(status, "HTTP/1.1 %d", &code); err != nil {
+		t.Fatalf("status line %q: %v", status, err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	return conn, r, code
+}
+
+// socks5 和 http 代理共用一个端口
+func TestServerHttpConnect(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, HttpProxy: true})
+	echo := startEchoServer(t)
+
+	conn, r, code := httpConnect(t, addr, echo, "")
+	if code != http.StatusOK {
+		t.Fatalf("connect status: %d", code)
+	}
+	if _, err := io.WriteString(conn, "tunnel"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("tunnel"))
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "tunnel" {
+		t.Fatalf("tunnel echo: %q, %v", got, err)
+	}
+
+	sconn, _ := dialSocks5(t, addr)
+	if resp := socks5Request(t, sconn, socks5.Socks5CmdConnect, echo); resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("socks5 connect reply: %d", resp.Rep)
+	}
+	echoRoundTrip(t, sconn, "socks5")
+}
+
+// http 代理与 socks 使用同样的用户名密码认证
+func TestServerHttpAuth(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p", HttpProxy: true})
+	echo := startEchoServer(t)
+
+	for _, tt := range []struct {
+		auth string
+		code int
+	}{
+		{auth: "", code: http.StatusProxyAuthRequired},
+		{auth: "u:wrong", code: http.StatusProxyAuthRequired},
+		{auth: "u:p", code: http.StatusOK},
+	} {
+		if _, _, code := httpConnect(t, addr, echo, tt.auth); code != tt.code {
+			t.Fatalf("auth %q: status %d, want %d", tt.auth, code, tt.code)
+		}
+	}
+}
+
+// 访问规则拒绝时返回 403, 连接目标失败时返回 502
+func TestServerHttpConnectFailed(t *testing.T) {
+	acl := mustCompileACL(t, &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Domains: []string{"denied.example"}})}})
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, HttpProxy: true, ACL: acl})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	_ = l.Close()
+
+	for _, tt := range []struct {
+		target string
+		code   int
+	}{
+		{target: "denied.example:443", code: http.StatusForbidden},
+		{target: closed, code: http.StatusBadGateway},
+	} {
+		if _, _, code := httpConnect(t, addr, tt.target, ""); code != tt.code {
+			t.Fatalf("%s: status %d, want %d", tt.target, code, tt.code)
+		}
+	}
+}
+
+// 空闲隧道不能被访问规则拒绝的来源复用
+func TestServerHttpTunnelNotSharedAcrossSources(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secret")
+	}))
+	defer target.Close()
+
+	acl := mustCompileACL(t, &ACL{Rules: []*ACLRule{denyRule(RuleMatch{Sources: []string{"127.0.0.2"}})}})
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, HttpProxy: true, ACL: acl})
+
+	get := func(source string) int {
+		t.Helper()
+
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(source)}}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			t.Skipf("dial from %s: %v", source, err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target.URL, target.Listener.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("127.0.0.2"); code != http.StatusForbidden {
+		t.Fatalf("denied source: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := get("127.0.0.1"); code != http.StatusOK {
+		t.Fatalf("allowed source: got %d, want %d", code, http.StatusOK)
+	}
+	if code := get("127.0.0.2"); code != http.StatusForbidden {
+		t.Fatalf("denied source after idle tunnel: got %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+// 服务端内置的 http 代理没有自己的监听和隧道池, Stop 不应 panic
+func TestServerHttpProxyStop(t *testing.T) {
+	s := NewServer(&ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, HttpProxy: true})
+	s.httpProxy.Stop()
+}
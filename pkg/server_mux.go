@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"errors"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// serveMux 应答 MUX 命令后把连接切换为多路复用会话, 每个流按认证后的连接处理一个 CONNECT,
+// 流继承会话的认证方式和用户名, 仍然经过访问规则和上游路由
+func (s *server) serveMux(sess *serverSession) error {
+	conn := sess.conn
+	if !s.config.Mux || sess.muxed {
+		_ = writeCmdResponse(conn, socks5.Socks5RepCommandNotSupported, nil)
+		_ = conn.Close()
+		return errors.New("mux not enabled")
+	}
+
+	if err := writeCmdResponse(conn, socks5.Socks5RepSuccess, nil); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	s.logger.Printf("mux: %s, user: %s", conn.RemoteAddr().String(), sess.username)
+	mux := newMuxSession(conn, false, s.config.MuxMaxStreams)
+
+	go func() {
+		select {
+		case <-s.stopCh:
+			_ = mux.close()
+		case <-mux.dieCh:
+		}
+	}()
+
+	for {
+		stream, err := mux.acceptStream()
+		if err != nil {
+			s.logger.Printf("mux closed: %s, error: %v", conn.RemoteAddr().String(), err)
+			return nil
+		}
+
+		go func() {
+			streamSess := &serverSession{conn: stream, method: sess.method, username: sess.username, muxed: true}
+			if err := s.cmdExec(streamSess); err != nil {
+				s.logger.Printf("mux stream cmd exec error: %v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// socks4/socks4a, 请求格式:
+//
+//	VN(4) CD DSTPORT DSTIP USERID NULL [HOST NULL]
+//
+// DSTIP 为 0.0.0.x (x 不为 0) 时为 socks4a, 目标为后面的 HOST, 由服务端解析
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+	socks4CmdBind    = 0x02
+
+	socks4RepGranted  = 90
+	socks4RepRejected = 91
+
+	// USERID/HOST 的最大长度
+	socks4MaxFieldLen = 255
+)
+
+var errSocks4AuthFailed = errors.New("socks4 userid not accepted")
+
+type socks4Request struct {
+	cmd    byte
+	port   uint16
+	ip     net.IP
+	userID string
+	// socks4a 的目标域名
+	host string
+}
+
+func readSocks4Request(r io.Reader) (*socks4Request, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	if head[0] != socks4Version {
+		return nil, fmt.Errorf("socks version not support: %d", head[0])
+	}
+
+	req := &socks4Request{
+		cmd:  head[1],
+		port: binary.BigEndian.Uint16(head[2:4]),
+		ip:   net.IP(head[4:8]),
+	}
+
+	userID, err := readSocks4String(r)
+	if err != nil {
+		return nil, err
+	}
+	req.userID = userID
+
+	if req.ip[0] == 0 && req.ip[1] == 0 && req.ip[2] == 0 && req.ip[3] != 0 {
+		host, err := readSocks4String(r)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			return nil, errors.New("socks4a empty host")
+		}
+		req.host = host
+	}
+
+	return req, nil
+}
+
+// readSocks4String 读取以 NULL 结尾的字符串
+func readSocks4String(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) >= socks4MaxFieldLen {
+			return "", errors.New("socks4 field too long")
+		}
+		s = append(s, b[0])
+	}
+}
+
+// cmdRequest 转成 socks5 请求, 复用 socks5 的访问规则和 connect/bind 处理
+func (r *socks4Request) cmdRequest() *socks5.Socks5CmdRequest {
+	req := &socks5.Socks5CmdRequest{
+		Ver:  socks4Version,
+		Cmd:  socks5.Socks5Cmd(r.cmd),
+		Atyp: socks5.Socks5AddrTypeIPv4,
+		Addr: socks5.Socks5Addr{Addr: r.ip.String(), Port: r.port},
+	}
+	if r.host != "" {
+		req.Atyp = socks5.Socks5AddrTypeDomainName
+		req.Addr.Addr = r.host
+	}
+	return req
+}
+
+// writeSocks4Response VN(0) CD DSTPORT DSTIP, bound 不是 ipv4 地址时 DSTIP 填 0
+func writeSocks4Response(w io.Writer, rep byte, bound net.Addr) error {
+	resp := make([]byte, 8)
+	resp[1] = rep
+
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(resp[2:4], uint16(tcpAddr.Port))
+		if ip := tcpAddr.IP.To4(); ip != nil {
+			copy(resp[4:8], ip)
+		}
+	}
+
+	_, err := w.Write(resp)
+	return err
+}
+
+// socks4Reply 把 socks5 的应答码转换为 socks4 的 granted/rejected
+func socks4Reply(conn net.Conn) cmdReply {
+	return func(rep socks5.Socks5Rep, bound net.Addr) error {
+		if rep != socks5.Socks5RepSuccess {
+			return writeSocks4Response(conn, socks4RepRejected, nil)
+		}
+		return writeSocks4Response(conn, socks4RepGranted, bound)
+	}
+}
+
+// authSocks4 按来源地址可用的认证方式校验 USERID, 返回认证后的用户名:
+// 允许用户名密码认证时 USERID 可以是 "user:password", 校验通过后用户名为 user;
+// 允许无认证时 USERID 未经校验, 不作为用户名, 访问规则按匿名用户匹配; 客户端证书通过校验时用户名为证书的 CommonName
+func (s *server) authSocks4(conn net.Conn, userID string) (string, error) {
+	user, password, hasPassword := strings.Cut(userID, ":")
+	if username, ok := s.authPassword(conn, user, password, hasPassword); ok {
+		return username, nil
+	}
+	return "", errSocks4AuthFailed
+}
+
+// serveSocks4 处理 socks4/socks4a 连接, 支持 CONNECT 和 BIND
+func (s *server) serveSocks4(conn net.Conn) error {
+	req, err := readSocks4Request(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	username, err := s.authSocks4(conn, req.userID)
+	if err != nil {
+		_ = writeSocks4Response(conn, socks4RepRejected, nil)
+		_ = conn.Close()
+		return err
+	}
+	sess := &serverSession{conn: conn, username: username}
+
+	cmdReq := req.cmdRequest()
+	if req.cmd != socks4CmdConnect && req.cmd != socks4CmdBind {
+		_ = writeSocks4Response(conn, socks4RepRejected, nil)
+		_ = conn.Close()
+		return fmt.Errorf("socks4 command not supported: %d", req.cmd)
+	}
+
+	aclReq := s.newACLRequest(sess, cmdReq)
+	ips, err := s.checkACL(aclReq)
+	if err != nil {
+		s.logger.Printf("acl: %s, user: %s, cmd: %d, dst: %s, error: %v", conn.RemoteAddr().String(), username, req.cmd, socks5HostPort(cmdReq.Addr), err)
+		_ = writeSocks4Response(conn, socks4RepRejected, nil)
+		_ = conn.Close()
+		return err
+	}
+
+	reply := socks4Reply(conn)
+	if req.cmd == socks4CmdConnect {
+		return s.serveConnect("socks4", sess, cmdReq, aclReq, ips, reply)
+	}
+	return s.serveBind("socks4", sess, cmdReq, reply)
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// socks4ConnectRequest 构造连接 addr (ipv4 "host:port") 的 socks4 CONNECT 请求
+func socks4ConnectRequest(t *testing.T, addr, userID string) []byte {
+	t.Helper()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socks4Version, socks4CmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(tcpAddr.Port))
+	req = append(req, tcpAddr.IP.To4()...)
+	req = append(req, userID...)
+	return append(req, 0)
+}
+
+// dialSocks4 连接服务端发送 req, 返回连接和应答
+func dialSocks4(t *testing.T, addr string, req []byte) (net.Conn, []byte) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	return conn, readSocks4Reply(t, conn)
+}
+
+func readSocks4Reply(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// USERID 为 user:password 时按用户名密码认证
+func TestSocks4Auth(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "user", Password: "pass"})
+	echo := startEchoServer(t)
+
+	for _, tt := range []struct {
+		userID string
+		rep    byte
+	}{
+		{userID: "user:pass", rep: socks4RepGranted},
+		{userID: "user:wrong", rep: socks4RepRejected},
+		{userID: "user", rep: socks4RepRejected},
+	} {
+		_, resp := dialSocks4(t, addr, socks4ConnectRequest(t, echo, tt.userID))
+		if resp[1] != tt.rep {
+			t.Fatalf("userid %q: reply %d", tt.userID, resp[1])
+		}
+	}
+}
+
+// 无认证时 USERID 未经校验, 不能冒充用户名通过访问规则
+func TestSocks4UserIDNotTrusted(t *testing.T) {
+	acl := mustCompileACL(t, &ACL{
+		DenyPrivate: true,
+		Rules:       []*ACLRule{{Action: aclActionAllow, RuleMatch: RuleMatch{Users: []string{"admin"}}}},
+	})
+	addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []socks5.Socks5Method{socks5.Socks5MethodUserPass, socks5.Socks5MethodNoAuth},
+		User:        "admin",
+		Password:    "secret",
+		ACL:         acl,
+	})
+	echo := startEchoServer(t)
+
+	for _, tt := range []struct {
+		userID string
+		rep    byte
+	}{
+		{userID: "admin", rep: socks4RepRejected},
+		{userID: "admin:secret", rep: socks4RepGranted},
+	} {
+		_, resp := dialSocks4(t, addr, socks4ConnectRequest(t, echo, tt.userID))
+		if resp[1] != tt.rep {
+			t.Fatalf("userid %q: reply %d, want %d", tt.userID, resp[1], tt.rep)
+		}
+	}
+}
+
+func TestSocks4Connect(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startEchoServer(t)
+
+	conn, resp := dialSocks4(t, addr, socks4ConnectRequest(t, echo, "anyone"))
+	if resp[1] != socks4RepGranted {
+		t.Fatalf("reply: %d", resp[1])
+	}
+	echoRoundTrip(t, conn, "ping")
+
+	// 连接失败时拒绝
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	_ = l.Close()
+	if _, resp := dialSocks4(t, addr, socks4ConnectRequest(t, closed, "")); resp[1] != socks4RepRejected {
+		t.Fatalf("connect closed port reply: %d", resp[1])
+	}
+}
+
+// socks4a 的目标为 DSTIP 后面的域名, 由服务端解析
+func TestSocks4aConnect(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	p, _ := strconv.Atoi(port)
+
+	req := []byte{socks4Version, socks4CmdConnect, 0, 0, 0, 0, 0, 1, 0}
+	binary.BigEndian.PutUint16(req[2:4], uint16(p))
+	req = append(append(req, "localhost"...), 0)
+
+	conn, resp := dialSocks4(t, addr, req)
+	if resp[1] != socks4RepGranted {
+		t.Fatalf("reply: %d", resp[1])
+	}
+	echoRoundTrip(t, conn, "ping4a")
+}
+
+// BIND 两次应答: 监听地址和对端地址
+func TestSocks4Bind(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+
+	req := []byte{socks4Version, socks4CmdBind, 0, 0, 127, 0, 0, 1, 0}
+	conn, resp := dialSocks4(t, addr, req)
+	if resp[1] != socks4RepGranted {
+		t.Fatalf("first reply: %d", resp[1])
+	}
+	port := binary.BigEndian.Uint16(resp[2:4])
+	listen := net.JoinHostPort(net.IP(resp[4:8]).String(), strconv.Itoa(int(port)))
+
+	peer, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	resp = readSocks4Reply(t, conn)
+	if resp[1] != socks4RepGranted {
+		t.Fatalf("second reply: %d", resp[1])
+	}
+	if got := int(binary.BigEndian.Uint16(resp[2:4])); got != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("peer port: %d", got)
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("bind data: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,365 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+const (
+	// 一个关联记录的目标地址数上限, 超过时先清理过期的, 仍超过时去掉最久没有发送过的
+	udpMaxRemotes = 1024
+	// 目标地址超过该时间没有发送过报文时不再转发它的回包
+	udpRemoteTimeout = 2 * time.Minute
+)
+
+type serverCmdUdpAssociate struct {
+	cliConn   net.Conn
+	cmd       *socks5.Socks5CmdRequest
+	relayConn *net.UDPConn
+	// 发往目标的报文从该端口发出, 绑定在全零地址上, 不受控制连接所在地址 (如 127.0.0.1) 的限制
+	outConn  *net.UDPConn
+	stopCh   chan struct{}
+	acl      *ACL
+	username string
+
+	// 保护 cliAddr 和 remotes, 转发和回包在不同的 goroutine 中
+	mu sync.Mutex
+	// 客户端的 udp 地址, 收到客户端第一个报文后确定
+	cliAddr *net.UDPAddr
+	// 客户端发送过的目标地址和最近一次发送的时间, 只转发这些地址的回包
+	remotes map[string]time.Time
+
+	// 本地 socks5 服务通过远端 socks5 服务端的 udp 关联收发报文, 不为空时不直接发往目标
+	remote     *Dialer
+	remoteConn net.PacketConn
+
+	closeOnce sync.Once
+	doneCh    chan struct{}
+}
+
+// listen 在控制连接所在的本地地址上分配与客户端通信的 udp 端口, 另外分配发往目标的端口
+func (s *serverCmdUdpAssociate) listen() error {
+	laddr := &net.UDPAddr{}
+	if tcpAddr, ok := s.cliConn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = tcpAddr.IP
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+
+	if s.remote != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		defer cancel()
+
+		remoteConn, err := s.remote.ListenPacket(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		s.remoteConn = remoteConn
+	} else {
+		outConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		s.outConn = outConn
+	}
+
+	s.relayConn = conn
+	s.remotes = make(map[string]time.Time)
+	s.doneCh = make(chan struct{})
+	return nil
+}
+
+func (s *serverCmdUdpAssociate) response(rep socks5.Socks5Rep) error {
+	var bound net.Addr
+	if s.relayConn != nil {
+		bound = s.relayConn.LocalAddr()
+	}
+
+	return writeCmdResponse(s.cliConn, rep, bound)
+}
+
+func (s *serverCmdUdpAssociate) close() {
+	s.closeOnce.Do(func() {
+		if s.doneCh != nil {
+			close(s.doneCh)
+		}
+
+		if s.cliConn != nil {
+			_ = s.cliConn.Close()
+		}
+
+		if s.relayConn != nil {
+			_ = s.relayConn.Close()
+		}
+
+		if s.outConn != nil {
+			_ = s.outConn.Close()
+		}
+
+		if s.remoteConn != nil {
+			_ = s.remoteConn.Close()
+		}
+	})
+}
+
+// run 转发 udp 报文, 控制连接断开或服务停止时结束关联
+func (s *serverCmdUdpAssociate) run() {
+	go func() {
+		// 控制连接上不会再有数据, 读到 EOF 说明客户端已断开
+		_, _ = io.Copy(io.Discard, s.cliConn)
+		s.close()
+	}()
+
+	go func() {
+		select {
+		case <-s.stopCh:
+			s.close()
+		case <-s.doneCh:
+		}
+	}()
+
+	if s.remoteConn != nil {
+		go func() {
+			defer s.close()
+
+			buf := make([]byte, udpBufferSize)
+			for {
+				n, from, err := s.remoteConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				s.replyRemote(from, buf[:n])
+			}
+		}()
+	}
+
+	if s.outConn != nil {
+		go func() {
+			defer s.close()
+
+			buf := make([]byte, udpBufferSize)
+			for {
+				n, from, err := s.outConn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				s.reply(from, buf[:n])
+			}
+		}()
+	}
+
+	go func() {
+		defer s.close()
+
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := s.relayConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			// 中继端口只接收客户端的报文
+			if s.isClient(from) {
+				s.forward(buf[:n])
+			}
+		}
+	}()
+}
+
+// isClient 判断报文是否来自客户端:
+// 源 ip 需与控制连接一致, 请求中带了端口时端口也需一致
+func (s *serverCmdUdpAssociate) isClient(from *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cliAddr != nil {
+		return s.cliAddr.IP.Equal(from.IP) && s.cliAddr.Port == from.Port
+	}
+
+	tcpAddr, ok := s.cliConn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(from.IP) {
+		return false
+	}
+
+	if s.cmd.Addr.Port != 0 && int(s.cmd.Addr.Port) != from.Port {
+		return false
+	}
+
+	s.cliAddr = from
+	return true
+}
+
+// forward 去掉报文头后发往目标地址
+func (s *serverCmdUdpAssociate) forward(data []byte) {
+	p, err := unpackUdpPackage(data)
+	if err != nil {
+		log.Printf("udp package from %s error: %v\n", s.cliAddr, err)
+		return
+	}
+
+	// 不支持分片, RFC 1928 要求丢弃 FRAG 不为 0 的报文
+	if p.Frag != 0 {
+		log.Printf("udp fragment from %s dropped, frag: %d\n", s.cliAddr, p.Frag)
+		return
+	}
+
+	// 通过远端转发时由远端解析域名
+	if s.remoteConn != nil {
+		if !s.allow(p, nil) {
+			return
+		}
+
+		if _, err := s.remoteConn.WriteTo(p.Data, socks5NetAddrOf("udp", p.Atyp, p.Addr)); err != nil {
+			log.Printf("udp write to %s via remote error: %v\n", socks5HostPort(p.Addr), err)
+		}
+		return
+	}
+
+	dst, err := net.ResolveUDPAddr("udp", socks5HostPort(p.Addr))
+	if err != nil {
+		log.Printf("udp resolve %s error: %v\n", p.Addr.Addr, err)
+		return
+	}
+
+	if !s.allow(p, dst.IP) {
+		return
+	}
+
+	s.addRemote(dst.String(), time.Now())
+	if _, err := s.outConn.WriteToUDP(p.Data, dst); err != nil {
+		log.Printf("udp write to %s error: %v\n", dst, err)
+	}
+}
+
+// allow 校验报文的目标地址, ip 为空时目标为域名的只按域名匹配
+func (s *serverCmdUdpAssociate) allow(p *socks5.Socks5UdpPackage, ip net.IP) bool {
+	if s.acl == nil {
+		return true
+	}
+
+	req := &aclRequest{
+		cmd:      socks5.Socks5CmdUdpAssociate,
+		source:   s.cliAddr.IP,
+		username: s.username,
+		port:     p.Addr.Port,
+	}
+	if p.Atyp == socks5.Socks5AddrTypeDomainName {
+		req.host = p.Addr.Addr
+	} else if ip == nil {
+		ip = net.ParseIP(p.Addr.Addr)
+	}
+	if ip != nil {
+		req.ips = []net.IP{ip}
+	}
+
+	if !s.acl.allow(req) {
+		log.Printf("udp to %s denied, user: %s\n", socks5HostPort(p.Addr), s.username)
+		return false
+	}
+	return true
+}
+
+// addRemote 记录客户端发送过的目标地址, 数量超过 udpMaxRemotes 时清理
+func (s *serverCmdUdpAssociate) addRemote(addr string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remotes[addr] = now
+	if len(s.remotes) <= udpMaxRemotes {
+		return
+	}
+
+	var oldest string
+	var oldestAt time.Time
+	for a, seen := range s.remotes {
+		if now.Sub(seen) > udpRemoteTimeout {
+			delete(s.remotes, a)
+			continue
+		}
+		if oldest == "" || seen.Before(oldestAt) {
+			oldest, oldestAt = a, seen
+		}
+	}
+	if len(s.remotes) > udpMaxRemotes && oldest != "" {
+		delete(s.remotes, oldest)
+	}
+}
+
+// knownRemote 目标地址最近发送过报文时返回客户端地址, 否则返回空
+func (s *serverCmdUdpAssociate) knownRemote(addr string, now time.Time) *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen, ok := s.remotes[addr]
+	if !ok || now.Sub(seen) > udpRemoteTimeout {
+		return nil
+	}
+	return s.cliAddr
+}
+
+// reply 加上报文头后发回客户端
+func (s *serverCmdUdpAssociate) reply(from *net.UDPAddr, data []byte) {
+	cliAddr := s.knownRemote(from.String(), time.Now())
+	if cliAddr == nil {
+		return
+	}
+
+	atyp, addr := socks5AddrOf(from)
+	packet, err := packUdpPackage(&socks5.Socks5UdpPackage{
+		Atyp: atyp,
+		Addr: addr,
+		Data: data,
+	})
+	if err != nil {
+		log.Printf("udp pack reply from %s error: %v\n", from, err)
+		return
+	}
+
+	if _, err := s.relayConn.WriteToUDP(packet, cliAddr); err != nil {
+		log.Printf("udp write to client %s error: %v\n", cliAddr, err)
+	}
+}
+
+// replyRemote 把远端转回的报文加上报文头后发回客户端
+func (s *serverCmdUdpAssociate) replyRemote(from net.Addr, data []byte) {
+	s.mu.Lock()
+	cliAddr := s.cliAddr
+	s.mu.Unlock()
+
+	if cliAddr == nil {
+		return
+	}
+
+	var atyp socks5.Socks5AddrType
+	var addr socks5.Socks5Addr
+	if a, ok := from.(*socks5NetAddr); ok {
+		atyp, addr = socks5.Socks5AddrTypeDomainName, a.addr
+	} else {
+		atyp, addr = socks5AddrOf(from)
+	}
+
+	packet, err := packUdpPackage(&socks5.Socks5UdpPackage{
+		Atyp: atyp,
+		Addr: addr,
+		Data: data,
+	})
+	if err != nil {
+		log.Printf("udp pack reply from %s error: %v\n", from, err)
+		return
+	}
+
+	if _, err := s.relayConn.WriteToUDP(packet, cliAddr); err != nil {
+		log.Printf("udp write to client %s error: %v\n", cliAddr, err)
+	}
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// udpAssociate 建立 udp 关联, 返回控制连接和中继地址
+func udpAssociate(t *testing.T, addr string, local *net.UDPConn) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+
+	conn, _ := dialSocks5(t, addr)
+	resp := socks5Request(t, conn, socks5.Socks5CmdUdpAssociate, local.LocalAddr().String())
+	if resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("udp associate reply: %d", resp.Rep)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", socks5HostPort(resp.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, relay
+}
+
+// udpRoundTrip 通过中继把 data 发往 dst, 返回回包的来源和内容
+func udpRoundTrip(t *testing.T, local *net.UDPConn, relay, dst *net.UDPAddr, data []byte) (string, []byte) {
+	t.Helper()
+
+	atyp, addr := socks5AddrOf(dst)
+	packet, err := packUdpPackage(&socks5.Socks5UdpPackage{Atyp: atyp, Addr: addr, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.WriteToUDP(packet, relay); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = local.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, udpBufferSize)
+	n, _, err := local.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := unpackUdpPackage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return socks5HostPort(p.Addr), p.Data
+}
+
+func TestServerUdpAssociate(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startUdpEchoServer(t, net.IPv4(127, 0, 0, 1))
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	_, relay := udpAssociate(t, addr, local)
+	from, data := udpRoundTrip(t, local, relay, echo, []byte("ping"))
+	if from != echo.String() || !bytes.Equal(data, []byte("ping")) {
+		t.Fatalf("got %q from %s", data, from)
+	}
+}
+
+// 控制连接为 ipv6 时, 中继仍能把报文发往 ipv4 的目标
+func TestServerUdpAssociateIPv6ToIPv4(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, Addr: "::1"})
+	echo := startUdpEchoServer(t, net.IPv4(127, 0, 0, 1))
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	_, relay := udpAssociate(t, addr, local)
+	from, data := udpRoundTrip(t, local, relay, echo, []byte("ping"))
+	if from != echo.String() || !bytes.Equal(data, []byte("ping")) {
+		t.Fatalf("got %q from %s", data, from)
+	}
+}
+
+// 控制连接断开时关闭中继端口
+func TestServerUdpAssociateClosed(t *testing.T) {
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth})
+	echo := startUdpEchoServer(t, net.IPv4(127, 0, 0, 1))
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	conn, relay := udpAssociate(t, addr, local)
+	udpRoundTrip(t, local, relay, echo, []byte("ping"))
+	_ = conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	atyp, dst := socks5AddrOf(echo)
+	packet, _ := packUdpPackage(&socks5.Socks5UdpPackage{Atyp: atyp, Addr: dst, Data: []byte("ping")})
+	_, _ = local.WriteToUDP(packet, relay)
+	_ = local.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := local.ReadFromUDP(make([]byte, udpBufferSize)); err == nil {
+		t.Fatal("relay still forwarding after control connection closed")
+	}
+}
+
+// 目标地址数有上限, 过期的目标不再转发回包
+func TestServerUdpRemotesBounded(t *testing.T) {
+	s := &serverCmdUdpAssociate{remotes: make(map[string]time.Time), cliAddr: &net.UDPAddr{}}
+	start := time.Now()
+
+	for i := 0; i < udpMaxRemotes+100; i++ {
+		s.addRemote(net.JoinHostPort("192.0.2.1", strconv.Itoa(i+1)), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(s.remotes) > udpMaxRemotes {
+		t.Fatalf("remotes: %d", len(s.remotes))
+	}
+	// 最早的目标被去掉
+	if s.knownRemote("192.0.2.1:1", start.Add(time.Second)) != nil {
+		t.Fatal("oldest remote kept")
+	}
+	last := fmt.Sprintf("192.0.2.1:%d", udpMaxRemotes+100)
+	if s.knownRemote(last, start.Add(time.Second)) == nil {
+		t.Fatal("latest remote dropped")
+	}
+	if s.knownRemote(last, start.Add(2*udpRemoteTimeout)) != nil {
+		t.Fatal("expired remote still known")
+	}
+
+	// 全部过期后只保留新的目标
+	s.addRemote("192.0.2.2:1", start.Add(2*udpRemoteTimeout))
+	for i := 0; i < udpMaxRemotes; i++ {
+		s.addRemote(net.JoinHostPort("192.0.2.3", strconv.Itoa(i+1)), start.Add(2*udpRemoteTimeout))
+	}
+	if len(s.remotes) > udpMaxRemotes {
+		t.Fatalf("remotes after expiry: %d", len(s.remotes))
+	}
+}
@@ -1 +1,17 @@
 package pkg
+
+// NewLocalSocksServer 本地 socks5 服务, CONNECT 和 UDP ASSOCIATE 通过 remote 指定的远端 socks5 服务端转发;
+// 认证方式和访问规则与 NewServer 相同, Upstreams 不生效, 不支持 BIND
+func NewLocalSocksServer(config *ServerConfig, remote *ClientConfig) *server {
+	s := NewLocalSocksServerWithDialer(config, NewDialer(remote))
+	s.ownRemote = true
+	return s
+}
+
+// NewLocalSocksServerWithDialer 同 NewLocalSocksServer, 通过 remote 转发, 可以与 http 代理共享服务端的健康状态和连接;
+// Stop 时不关闭 remote
+func NewLocalSocksServerWithDialer(config *ServerConfig, remote *Dialer) *server {
+	s := NewServer(config)
+	s.remote = remote
+	return s
+}
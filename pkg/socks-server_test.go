@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// startLocalSocksServer 启动不认证的本地 socks5 服务, 通过需要用户名密码认证的远端服务端转发
+func startLocalSocksServer(t *testing.T) string {
+	t.Helper()
+
+	remote := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+	remoteConfig := testClientConfig(t, remote)
+	remoteConfig.AuthMethod = socks5.Socks5MethodUserPass
+	remoteConfig.Username = "u"
+	remoteConfig.Password = "p"
+
+	return startTestServerWith(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth}, func(config *ServerConfig) *server {
+		return NewLocalSocksServer(config, remoteConfig)
+	})
+}
+
+func TestLocalSocksServerConnect(t *testing.T) {
+	addr := startLocalSocksServer(t)
+	echo := startEchoServer(t)
+
+	conn, _ := dialSocks5(t, addr)
+	if resp := socks5Request(t, conn, socks5.Socks5CmdConnect, echo); resp.Rep != socks5.Socks5RepSuccess {
+		t.Fatalf("connect reply: %d", resp.Rep)
+	}
+	echoRoundTrip(t, conn, "via remote")
+}
+
+// 远端拒绝连接时本地服务端返回远端的应答
+func TestLocalSocksServerConnectRefused(t *testing.T) {
+	addr := startLocalSocksServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	_ = l.Close()
+
+	conn, _ := dialSocks5(t, addr)
+	if resp := socks5Request(t, conn, socks5.Socks5CmdConnect, closed); resp.Rep == socks5.Socks5RepSuccess {
+		t.Fatalf("connect to closed port succeeded")
+	}
+}
+
+func TestLocalSocksServerUdpAssociate(t *testing.T) {
+	addr := startLocalSocksServer(t)
+	echo := startUdpEchoServer(t, net.IPv4(127, 0, 0, 1))
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	_, relay := udpAssociate(t, addr, local)
+	from, data := udpRoundTrip(t, local, relay, echo, []byte("ping"))
+	if from != echo.String() || !bytes.Equal(data, []byte("ping")) {
+		t.Fatalf("got %q from %s", data, from)
+	}
+}
+
+func TestLocalSocksServerBindNotSupported(t *testing.T) {
+	addr := startLocalSocksServer(t)
+
+	conn, _ := dialSocks5(t, addr)
+	if resp := socks5Request(t, conn, socks5.Socks5CmdBind, "127.0.0.1:0"); resp.Rep != socks5.Socks5RepCommandNotSupported {
+		t.Fatalf("bind reply: %d, want %d", resp.Rep, socks5.Socks5RepCommandNotSupported)
+	}
+}
@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// socks5-protocol 的 SerializeIPv4/SerializeIPv6 按字符逐个写入, 无法处理点分/冒号格式的地址,
+// 这里按 RFC 1928 重新实现 ATYP + DST.ADDR + DST.PORT 的编解码
+
+var errAddrTypeNotSupported = errors.New("address type not supported")
+
+// readSocks5Addr 按 atyp 读取地址和端口
+func readSocks5Addr(r io.Reader, atyp socks5.Socks5AddrType) (socks5.Socks5Addr, error) {
+	var addr socks5.Socks5Addr
+	var host []byte
+
+	switch atyp {
+	case socks5.Socks5AddrTypeIPv4:
+		host = make([]byte, net.IPv4len)
+	case socks5.Socks5AddrTypeIPv6:
+		host = make([]byte, net.IPv6len)
+	case socks5.Socks5AddrTypeDomainName:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return addr, err
+		}
+		host = make([]byte, l[0])
+	default:
+		return addr, errAddrTypeNotSupported
+	}
+
+	if _, err := io.ReadFull(r, host); err != nil {
+		return addr, err
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return addr, err
+	}
+
+	if atyp == socks5.Socks5AddrTypeDomainName {
+		addr.Addr = string(host)
+	} else {
+		addr.Addr = net.IP(host).String()
+	}
+	addr.Port = binary.BigEndian.Uint16(port)
+
+	return addr, nil
+}
+
+// appendSocks5Addr 把地址和端口按 atyp 编码追加到 b
+func appendSocks5Addr(b []byte, atyp socks5.Socks5AddrType, addr socks5.Socks5Addr) ([]byte, error) {
+	switch atyp {
+	case socks5.Socks5AddrTypeIPv4:
+		ip := net.ParseIP(addr.Addr).To4()
+		if ip == nil {
+			return nil, errors.New("invalid ipv4 address: " + addr.Addr)
+		}
+		b = append(b, ip...)
+	case socks5.Socks5AddrTypeIPv6:
+		ip := net.ParseIP(addr.Addr).To16()
+		if ip == nil {
+			return nil, errors.New("invalid ipv6 address: " + addr.Addr)
+		}
+		b = append(b, ip...)
+	case socks5.Socks5AddrTypeDomainName:
+		if len(addr.Addr) == 0 || len(addr.Addr) > 255 {
+			return nil, errors.New("invalid domain name: " + addr.Addr)
+		}
+		b = append(b, byte(len(addr.Addr)))
+		b = append(b, addr.Addr...)
+	default:
+		return nil, errAddrTypeNotSupported
+	}
+
+	return binary.BigEndian.AppendUint16(b, addr.Port), nil
+}
+
+// socks5AddrOf 把 net.Addr 转成 socks5 地址, 无法识别时返回 0.0.0.0:0
+func socks5AddrOf(addr net.Addr) (socks5.Socks5AddrType, socks5.Socks5Addr) {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return socks5.Socks5AddrTypeIPv4, socks5.Socks5Addr{Addr: ip4.String(), Port: uint16(port)}
+	}
+	if len(ip) == net.IPv6len {
+		return socks5.Socks5AddrTypeIPv6, socks5.Socks5Addr{Addr: ip.String(), Port: uint16(port)}
+	}
+
+	return socks5.Socks5AddrTypeIPv4, socks5.Socks5Addr{Addr: net.IPv4zero.String(), Port: 0}
+}
+
+// socks5AddrTypeOf 按 host 的格式返回地址类型
+func socks5AddrTypeOf(host string) socks5.Socks5AddrType {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return socks5.Socks5AddrTypeDomainName
+	case ip.To4() != nil:
+		return socks5.Socks5AddrTypeIPv4
+	default:
+		return socks5.Socks5AddrTypeIPv6
+	}
+}
+
+// socks5HostPort 返回可直接用于 net.Dial 的 host:port
+func socks5HostPort(addr socks5.Socks5Addr) string {
+	return net.JoinHostPort(addr.Addr, strconv.Itoa(int(addr.Port)))
+}
+
+// writeCmdResponse 写入命令应答, bound 为 BND.ADDR/BND.PORT, 为 nil 时填 0.0.0.0:0
+func writeCmdResponse(w io.Writer, rep socks5.Socks5Rep, bound net.Addr) error {
+	atyp, addr := socks5AddrOf(bound)
+
+	data := []byte{byte(socks5.Socks5Version5), byte(rep), socks5.Socks5Reserved, byte(atyp)}
+	data, err := appendSocks5Addr(data, atyp, addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// readCmdRequest 读取命令请求, ATYP 无法识别时返回 errAddrTypeNotSupported
+func readCmdRequest(r io.Reader) (*socks5.Socks5CmdRequest, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	req := &socks5.Socks5CmdRequest{
+		Ver:  socks5.Socks5Version(header[0]),
+		Cmd:  socks5.Socks5Cmd(header[1]),
+		Rsv:  header[2],
+		Atyp: socks5.Socks5AddrType(header[3]),
+	}
+
+	addr, err := readSocks5Addr(r, req.Atyp)
+	if err != nil {
+		return req, err
+	}
+	req.Addr = addr
+
+	return req, nil
+}
+
+// writeCmdRequest 写入命令请求
+func writeCmdRequest(w io.Writer, req *socks5.Socks5CmdRequest) error {
+	data := []byte{byte(req.Ver), byte(req.Cmd), req.Rsv, byte(req.Atyp)}
+	data, err := appendSocks5Addr(data, req.Atyp, req.Addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// readCmdResponse 读取命令应答
+func readCmdResponse(r io.Reader) (*socks5.Socks5CmdResponse, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	resp := &socks5.Socks5CmdResponse{
+		Ver:  socks5.Socks5Version(header[0]),
+		Rep:  socks5.Socks5Rep(header[1]),
+		Rsv:  header[2],
+		Atyp: socks5.Socks5AddrType(header[3]),
+	}
+
+	addr, err := readSocks5Addr(r, resp.Atyp)
+	if err != nil {
+		return resp, err
+	}
+	resp.Addr = addr
+
+	return resp, nil
+}
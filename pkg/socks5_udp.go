@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// RFC 1928 UDP 报文头:
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+// socks5.Socks5UdpPackage 的序列化在 DATA 前多了两字节长度, 与 RFC 不兼容, 这里只复用结构体
+
+const udpBufferSize = 65535
+
+// unpackUdpPackage 解析 udp 报文, Data 引用 b 中的数据
+func unpackUdpPackage(b []byte) (*socks5.Socks5UdpPackage, error) {
+	if len(b) < 4 {
+		return nil, errors.New("udp package too short")
+	}
+
+	p := &socks5.Socks5UdpPackage{}
+	p.Rsv[0], p.Rsv[1] = b[0], b[1]
+	p.Frag = b[2]
+	p.Atyp = socks5.Socks5AddrType(b[3])
+
+	r := bytes.NewReader(b[4:])
+	addr, err := readSocks5Addr(r, p.Atyp)
+	if err != nil {
+		return nil, err
+	}
+	p.Addr = addr
+	p.Data = b[len(b)-r.Len():]
+
+	return p, nil
+}
+
+// packUdpPackage 按 RFC 1928 编码 udp 报文
+func packUdpPackage(p *socks5.Socks5UdpPackage) ([]byte, error) {
+	data := make([]byte, 0, 4+1+255+2+len(p.Data))
+	data = append(data, p.Rsv[0], p.Rsv[1], p.Frag, byte(p.Atyp))
+
+	data, err := appendSocks5Addr(data, p.Atyp, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, p.Data...), nil
+}
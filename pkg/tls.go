@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// NewServerTLSConfig 加载服务端证书; clientCAFile 不为空时要求客户端证书并用该 CA 校验 (mutual tls),
+// 客户端证书的 CommonName 作为用户名
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// NewClientTLSConfig caFile 不为空时只信任该 CA 签发的服务端证书; serverName 不为空时覆盖 SNI 和校验证书用的名字,
+// 为空时使用 RemoteAddr; certFile/keyFile 不为空时提供客户端证书
+func NewClientTLSConfig(caFile, serverName, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return pool, nil
+}
+
+// tlsUsername 返回通过校验的客户端证书的 CommonName, 不是 tls 连接或没有客户端证书时返回空
+func tlsUsername(conn net.Conn) string {
+	if bc, ok := conn.(*bufferedConn); ok {
+		conn = bc.Conn
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
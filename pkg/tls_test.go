@@ -0,0 +1,308 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+// testCert 测试用的证书和私钥, 以 pem 文件保存
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert 签发证书, parent 为空时自签名为 CA
+func newTestCert(t *testing.T, name string, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	if err := os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, name, nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+}
+
+func newTestServerCert(t *testing.T, ca *testCert) *testCert {
+	return newTestCert(t, "server", ca, &x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+}
+
+func newTestClientCert(t *testing.T, name string, ca *testCert) *testCert {
+	return newTestCert(t, name, ca, &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+}
+
+// tlsTestEnv 要求客户端证书的 tls 服务端, 只允许用户 alice 访问
+type tlsTestEnv struct {
+	ca   *testCert
+	addr string
+	echo string
+}
+
+func newTLSTestEnv(t *testing.T) *tlsTestEnv {
+	t.Helper()
+
+	ca := newTestCA(t, "test ca")
+	serverCert := newTestServerCert(t, ca)
+	tlsConfig, err := NewServerTLSConfig(serverCert.certFile, serverCert.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := &ACL{
+		Default: aclActionDeny,
+		Rules:   []*ACLRule{{Action: aclActionAllow, RuleMatch: RuleMatch{Users: []string{"alice"}}}},
+	}
+	if err := acl.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTestServer(t, &ServerConfig{
+		AuthMethod: socks5.Socks5MethodUserPass,
+		User:       "user",
+		Password:   "pass",
+		ACL:        acl,
+		HttpProxy:  true,
+		TLSConfig:  tlsConfig,
+	})
+	return &tlsTestEnv{ca: ca, addr: addr, echo: startEchoServer(t)}
+}
+
+// clientTLSConfig 使用 name 的客户端证书, ca 为空时使用 env 的 CA 签发
+func (env *tlsTestEnv) clientTLSConfig(t *testing.T, name string, ca *testCert) *tls.Config {
+	t.Helper()
+
+	if ca == nil {
+		ca = env.ca
+	}
+	cert := newTestClientCert(t, name, ca)
+	config, err := NewClientTLSConfig(env.ca.certFile, "", cert.certFile, cert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// dialTLS 直接建立 tls 连接, 用于 socks4 和 http
+func (env *tlsTestEnv) dialTLS(t *testing.T, config *tls.Config) *tls.Conn {
+	t.Helper()
+
+	config = config.Clone()
+	config.ServerName = "127.0.0.1"
+	conn, err := tls.Dial("tcp", env.addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// 客户端证书的 CommonName 作为 socks5, socks4 和 http 的用户名, 由访问规则按用户名放行
+func TestTLSCertUsername(t *testing.T) {
+	env := newTLSTestEnv(t)
+
+	for _, tt := range []struct {
+		name  string
+		allow bool
+	}{
+		{name: "alice", allow: true},
+		{name: "mallory", allow: false},
+	} {
+		config := env.clientTLSConfig(t, tt.name, nil)
+
+		t.Run("socks5/"+tt.name, func(t *testing.T) {
+			clientConfig := testClientConfig(t, env.addr)
+			clientConfig.TLSConfig = config
+			conn, err := NewDialer(clientConfig).Dial("tcp", env.echo)
+			if err == nil {
+				_ = conn.Close()
+			}
+			if (err == nil) != tt.allow {
+				t.Fatalf("connect: %v", err)
+			}
+		})
+
+		t.Run("socks4/"+tt.name, func(t *testing.T) {
+			conn := env.dialTLS(t, config)
+			// USERID 不是有效的用户名密码, 只能通过证书认证
+			if _, err := conn.Write(socks4ConnectRequest(t, env.echo, "bob")); err != nil {
+				t.Fatal(err)
+			}
+			resp := make([]byte, 8)
+			if _, err := conn.Read(resp); err != nil {
+				t.Fatal(err)
+			}
+			if (resp[1] == socks4RepGranted) != tt.allow {
+				t.Fatalf("socks4 reply: %d", resp[1])
+			}
+		})
+
+		t.Run("http/"+tt.name, func(t *testing.T) {
+			conn := env.dialTLS(t, config)
+			if _, err := conn.Write([]byte("CONNECT " + env.echo + " HTTP/1.1\r\nHost: " + env.echo + "\r\n\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (resp.StatusCode == http.StatusOK) != tt.allow {
+				t.Fatalf("http status: %s", resp.Status)
+			}
+		})
+	}
+}
+
+// 客户端证书未通过校验时不能选择 NoAuth
+func TestTLSNoAuthRequiresVerifiedCert(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	serverCert := newTestServerCert(t, ca)
+	tlsConfig, err := NewServerTLSConfig(serverCert.certFile, serverCert.keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 请求但不校验客户端证书
+	tlsConfig.ClientAuth = tls.RequestClientCert
+
+	addr := startTestServer(t, &ServerConfig{
+		AuthMethod: socks5.Socks5MethodUserPass,
+		User:       "user",
+		Password:   "pass",
+		TLSConfig:  tlsConfig,
+	})
+	echo := startEchoServer(t)
+
+	clientCert := newTestClientCert(t, "alice", ca)
+	clientTLS, err := NewClientTLSConfig(ca.certFile, "", clientCert.certFile, clientCert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testClientConfig(t, addr)
+	config.TLSConfig = clientTLS
+	if _, err := NewDialer(config).Dial("tcp", echo); !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Fatalf("noauth with unverified cert: %v", err)
+	}
+
+	config.AuthMethod = socks5.Socks5MethodUserPass
+	config.Username = "user"
+	config.Password = "pass"
+	conn, err := NewDialer(config).Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("user password over tls: %v", err)
+	}
+	_ = conn.Close()
+}
+
+// ServerName 为空时按 RemoteAddr 校验服务端证书
+func TestTLSServerNameFromRemoteAddr(t *testing.T) {
+	env := newTLSTestEnv(t)
+	config := env.clientTLSConfig(t, "alice", nil)
+	if config.ServerName != "" {
+		t.Fatalf("server name: %s", config.ServerName)
+	}
+
+	clientConfig := testClientConfig(t, env.addr)
+	clientConfig.TLSConfig = config
+	conn, err := NewDialer(clientConfig).Dial("tcp", env.echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if config.ServerName != "" {
+		t.Fatal("client tls config modified")
+	}
+
+	// 服务端证书只包含 127.0.0.1, 用其他名字连接时校验失败
+	_, port, _ := net.SplitHostPort(env.addr)
+	clientConfig.RemoteAddr = "localhost"
+	clientConfig.RemotePort, _ = strconv.Atoi(port)
+	if _, err := NewDialer(clientConfig).Dial("tcp", env.echo); err == nil {
+		t.Fatal("server cert verified for localhost")
+	}
+}
+
+// 客户端证书不是信任的 CA 签发时 tls 握手失败
+func TestTLSUntrustedClientCA(t *testing.T) {
+	env := newTLSTestEnv(t)
+	config := env.clientTLSConfig(t, "alice", newTestCA(t, "other ca"))
+
+	clientConfig := testClientConfig(t, env.addr)
+	clientConfig.TLSConfig = config
+	if conn, err := NewDialer(clientConfig).Dial("tcp", env.echo); err == nil {
+		_ = conn.Close()
+		t.Fatal("client cert from untrusted ca accepted")
+	}
+}
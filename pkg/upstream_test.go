@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/ojbkgo/socks5-protocol"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		url  string
+		want Upstream
+	}{
+		{"socks5://u:p@10.0.0.1:1080", Upstream{Type: UpstreamTypeSocks5, Addr: "10.0.0.1:1080", Username: "u", Password: "p"}},
+		{"socks4a://u@[::1]:1080", Upstream{Type: UpstreamTypeSocks4, Addr: "[::1]:1080", Username: "u"}},
+		{"http://proxy.example.com:3128", Upstream{Type: UpstreamTypeHttp, Addr: "proxy.example.com:3128"}},
+	}
+	for _, tt := range tests {
+		up, err := ParseUpstream(tt.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.url, err)
+		}
+		if *up != tt.want {
+			t.Fatalf("%s: %+v, want %+v", tt.url, *up, tt.want)
+		}
+	}
+
+	for _, url := range []string{"ftp://10.0.0.1:21", "socks5://10.0.0.1", "10.0.0.1:1080"} {
+		if _, err := ParseUpstream(url); err == nil {
+			t.Fatalf("parsed %s", url)
+		}
+	}
+}
+
+// startUpstream 启动一个需要用户名密码的 socks5 服务作为上游代理
+func startUpstream(t *testing.T) *Upstream {
+	t.Helper()
+
+	addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodUserPass, User: "u", Password: "p"})
+	return &Upstream{Type: UpstreamTypeSocks5, Addr: addr, Username: "u", Password: "p"}
+}
+
+// 依次经过两个 socks5 上游连接目标
+func TestDialChain(t *testing.T) {
+	chain := []*Upstream{startUpstream(t), startUpstream(t)}
+	echo := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(echo)
+	p, _ := strconv.Atoi(port)
+
+	conn, err := dialChain(chain, host, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echoRoundTrip(t, conn, "chained")
+}
+
+func TestDialChainRejected(t *testing.T) {
+	up := startUpstream(t)
+	up.Password = "wrong"
+
+	if conn, err := dialChain([]*Upstream{up}, "127.0.0.1", 80); err == nil {
+		_ = conn.Close()
+		t.Fatal("dial through upstream with wrong password succeeded")
+	}
+}
+
+func TestUpstreamRouterRoute(t *testing.T) {
+	router := &UpstreamRouter{
+		Upstreams: map[string]*Upstream{
+			"corp":   {Type: UpstreamTypeSocks5, Addr: "10.0.0.1:1080"},
+			"egress": {Type: UpstreamTypeHttp, Addr: "10.0.0.2:3128"},
+		},
+		Rules: []*UpstreamRule{
+			{Via: []string{}, RuleMatch: RuleMatch{DomainSuffixes: []string{"internal"}}},
+			{Via: []string{"corp"}, RuleMatch: RuleMatch{Networks: []string{"10.0.0.0/8"}}},
+		},
+		Default: []string{"corp", "egress"},
+	}
+	if err := router.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  *aclRequest
+		want int
+	}{
+		{"domain rule", &aclRequest{host: "git.internal", port: 443}, 0},
+		{"network rule", &aclRequest{ips: []net.IP{net.ParseIP("10.1.2.3")}, port: 443}, 1},
+		// 访问规则已解析过的地址直接使用, .invalid 再次解析会失败
+		{"acl resolved ips", &aclRequest{host: "db.invalid", ips: []net.IP{net.ParseIP("10.1.2.3")}, port: 443}, 1},
+		{"unresolvable", &aclRequest{host: "db.invalid", port: 443}, 2},
+		{"default", &aclRequest{ips: []net.IP{net.ParseIP("192.0.2.1")}, port: 443}, 2},
+	}
+	for _, tt := range tests {
+		if chain := router.route(tt.req); len(chain) != tt.want {
+			t.Errorf("%s: chain length %d, want %d", tt.name, len(chain), tt.want)
+		}
+	}
+
+	bad := &UpstreamRouter{Default: []string{"missing"}}
+	if err := bad.Compile(); err == nil {
+		t.Fatal("compiled router with unknown upstream")
+	}
+}
+
+// 服务端按路由经过上游代理连接目标, 上游不可用时连接失败
+func TestServerUpstream(t *testing.T) {
+	echo := startEchoServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	_ = l.Close()
+
+	for _, tt := range []struct {
+		name string
+		up   *Upstream
+		rep  socks5.Socks5Rep
+	}{
+		{"upstream", startUpstream(t), socks5.Socks5RepSuccess},
+		{"upstream down", &Upstream{Type: UpstreamTypeSocks5, Addr: closed}, socks5.Socks5RepConnectionRefused},
+	} {
+		router := &UpstreamRouter{Upstreams: map[string]*Upstream{"up": tt.up}, Default: []string{"up"}}
+		if err := router.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		addr := startTestServer(t, &ServerConfig{AuthMethod: socks5.Socks5MethodNoAuth, Upstreams: router})
+
+		conn, _ := dialSocks5(t, addr)
+		resp := socks5Request(t, conn, socks5.Socks5CmdConnect, echo)
+		if resp.Rep != tt.rep {
+			t.Fatalf("%s: connect reply %d, want %d", tt.name, resp.Rep, tt.rep)
+		}
+		if resp.Rep == socks5.Socks5RepSuccess {
+			echoRoundTrip(t, conn, "via upstream")
+		}
+		_ = conn.Close()
+	}
+}